@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// roleEditor may create, change and delete books and authors. Reads need no role.
+const roleEditor = "editor"
+
+// principal is who a request was made by
+type principal struct {
+	Subject string
+	Roles   []string
+}
+
+func (p principal) has(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator checks the credentials on a request: an HS256 JWT signed
+// with secret in "Authorization: Bearer", or a static API key for service
+// accounts in X-API-Key. With neither configured nobody can authenticate
+// and the API is read-only.
+type authenticator struct {
+	secret  []byte
+	apiKeys map[string]principal
+	now     func() time.Time
+}
+
+// auth is the authenticator the handlers use; set up from the config in main
+var auth = &authenticator{}
+
+var (
+	errNoCredentials = errors.New("no credentials")
+	errBadToken      = errors.New("invalid token")
+	errBadAPIKey     = errors.New("invalid api key")
+)
+
+// clockSkew is how far exp and nbf may be off before a token is refused
+const clockSkew = 30 * time.Second
+
+// newAuthenticator sets up auth from the config. apiKeys is a comma
+// separated list of name:key:role entries, e.g. "importer:s3cr3t:editor";
+// the name is what the key's requests are logged and audited as.
+func newAuthenticator(secret, apiKeys string) (*authenticator, error) {
+	a := &authenticator{apiKeys: map[string]principal{}}
+	if secret != "" {
+		a.secret = []byte(secret)
+	}
+	for i, entry := range strings.Split(apiKeys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("api key %d: want name:key:role", i+1)
+		}
+		a.apiKeys[parts[1]] = principal{Subject: "apikey:" + parts[0], Roles: []string{parts[2]}}
+	}
+	return a, nil
+}
+
+func (a *authenticator) authenticate(r *http.Request) (principal, error) {
+	return a.credentials(r.Header.Get("X-API-Key"), r.Header.Get("Authorization"))
+}
+
+// credentials checks an API key or, if there is none, an Authorization
+// header value, wherever they were sent
+func (a *authenticator) credentials(key, authz string) (principal, error) {
+	if key != "" {
+		for k, p := range a.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+				return p, nil
+			}
+		}
+		return principal{}, errBadAPIKey
+	}
+	if authz == "" {
+		return principal{}, errNoCredentials
+	}
+	const prefix = "bearer "
+	if len(authz) <= len(prefix) || !strings.EqualFold(authz[:len(prefix)], prefix) {
+		return principal{}, errBadToken
+	}
+	return a.verifyJWT(strings.TrimSpace(authz[len(prefix):]))
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Roles     []string `json:"roles"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// verifyJWT checks an HS256 token's signature and lifetime and returns the
+// subject and roles it carries
+func (a *authenticator) verifyJWT(token string) (principal, error) {
+	if len(a.secret) == 0 {
+		return principal{}, errBadToken
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return principal{}, errBadToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		// in particular, never accept "none"
+		return principal{}, errBadToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return principal{}, errBadToken
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return principal{}, errBadToken
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return principal{}, errBadToken
+	}
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	t := now()
+	if claims.ExpiresAt == nil || t.Add(-clockSkew).After(unixTime(*claims.ExpiresAt)) {
+		return principal{}, fmt.Errorf("%w: expired", errBadToken)
+	}
+	if claims.NotBefore != nil && t.Add(clockSkew).Before(unixTime(*claims.NotBefore)) {
+		return principal{}, fmt.Errorf("%w: not valid yet", errBadToken)
+	}
+	return principal{Subject: claims.Subject, Roles: claims.Roles}, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func unixTime(secs float64) time.Time {
+	return time.Unix(int64(secs), 0)
+}
+
+type principalKey struct{}
+
+// principalFrom returns who made the request, if requireRole let it through
+func principalFrom(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// actor names whoever made the request, for the change history
+func actor(r *http.Request) string {
+	p, _ := principalFrom(r.Context())
+	return p.Subject
+}
+
+// requireRole lets a request through to h only if it carries valid
+// credentials with the given role: 401 without (good) credentials, 403
+// with credentials that lack the role
+func requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := auth.authenticate(r)
+		if err != nil {
+			challenge := `Bearer realm="books"`
+			if !errors.Is(err, errNoCredentials) {
+				challenge += `, error="invalid_token"`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			writeProblem(w, r, http.StatusUnauthorized, "this needs a valid bearer token or API key: "+err.Error())
+			return
+		}
+		if !p.has(role) {
+			writeProblem(w, r, http.StatusForbidden, "this needs the "+role+" role")
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+func getAuthors(w http.ResponseWriter, r *http.Request) {
+	authors, err := store.ListAuthors()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if authors == nil {
+		authors = []Author{}
+	}
+	writeJSON(w, http.StatusOK, authors)
+}
+
+func getAuthor(w http.ResponseWriter, r *http.Request) {
+	author, err := store.GetAuthor(mux.Vars(r)["id"])
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, author)
+}
+
+func createAuthor(w http.ResponseWriter, r *http.Request) {
+	author, ok := readAuthor(w, r)
+	if !ok {
+		return
+	}
+	author, err := insertAuthor(author)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", apiPrefix(r)+"/authors/"+author.ID)
+	writeJSON(w, http.StatusCreated, author)
+}
+
+// insertAuthor stores author under a fresh ID, like insertBook
+func insertAuthor(author Author) (Author, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		author.ID = ids.NewID()
+		created, err := store.CreateAuthor(author)
+		if !errors.Is(err, ErrDuplicateID) {
+			return created, err
+		}
+	}
+	return Author{}, errors.New("could not generate a unique author id")
+}
+
+func updateAuthor(w http.ResponseWriter, r *http.Request) {
+	author, ok := readAuthor(w, r)
+	if !ok {
+		return
+	}
+	author.ID = mux.Vars(r)["id"]
+	author, err := store.UpdateAuthor(author.ID, author)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, author)
+}
+
+func deleteAuthor(w http.ResponseWriter, r *http.Request) {
+	if err := store.DeleteAuthor(mux.Vars(r)["id"]); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getAuthorBooks lists the books of one author, with the same paging,
+// filtering and sorting as GET /api/books
+func getAuthorBooks(w http.ResponseWriter, r *http.Request) {
+	q, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if _, err := store.GetAuthor(id); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	books, err := store.List()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	var theirs []Book
+	for _, b := range books {
+		if b.AuthorID == id {
+			theirs = append(theirs, b)
+		}
+	}
+	theirs, err = withAuthors(theirs)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	page, total := q.apply(theirs)
+	setPageHeaders(w, r, q, total)
+	writeJSON(w, http.StatusOK, present(r, page))
+}
+
+// readAuthor decodes and validates an Author from the request body. If the
+// body is unusable it has already written the 400 or 422 response.
+func readAuthor(w http.ResponseWriter, r *http.Request) (Author, bool) {
+	var author Author
+	if err := json.NewDecoder(r.Body).Decode(&author); err != nil {
+		badBody(w, r, "a valid author", err)
+		return Author{}, false
+	}
+	if err := author.Validate(); err != nil {
+		writeInvalid(w, r, "author", err.(ValidationErrors))
+		return Author{}, false
+	}
+	return author, true
+}
+
+// resolveAuthor points book at a stored author. An author_id is used as is
+// (the store checks it exists). An embedded author, as older clients send,
+// is matched by name against the stored authors and created if there is no
+// match, so a book never carries its own copy of the author.
+func resolveAuthor(book *Book) error {
+	if book.AuthorID != "" || book.Author == nil {
+		book.Author = nil
+		return nil
+	}
+	authors, err := store.ListAuthors()
+	if err != nil {
+		return err
+	}
+	for _, a := range authors {
+		if strings.EqualFold(a.Firstname, book.Author.Firstname) && strings.EqualFold(a.Lastname, book.Author.Lastname) {
+			book.AuthorID, book.Author = a.ID, nil
+			return nil
+		}
+	}
+	// two requests naming the same new author at once can both end up here
+	// and create it twice; the duplicate is harmless and can be merged by hand
+	created, err := insertAuthor(Author{Firstname: book.Author.Firstname, Lastname: book.Author.Lastname})
+	if err != nil {
+		return err
+	}
+	book.AuthorID, book.Author = created.ID, nil
+	return nil
+}
+
+// withAuthors returns copies of books with Author filled in from the store
+func withAuthors(books []Book) ([]Book, error) {
+	authors, err := store.ListAuthors()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Author, len(authors))
+	for _, a := range authors {
+		byID[a.ID] = a
+	}
+	expanded := make([]Book, len(books))
+	for i, b := range books {
+		if a, ok := byID[b.AuthorID]; ok {
+			b.Author = &a
+		}
+		expanded[i] = b
+	}
+	return expanded, nil
+}
+
+// present drops the embedded authors from books unless the client asked
+// for them with ?expand=author
+func present(r *http.Request, books []Book) []Book {
+	if r.URL.Query().Get("expand") == "author" {
+		return books
+	}
+	plain := make([]Book, len(books))
+	for i, b := range books {
+		b.Author = nil
+		plain[i] = b
+	}
+	return plain
+}
+
+// presentBook is present for a single book; it looks the author up itself
+func presentBook(r *http.Request, book Book) Book {
+	if r.URL.Query().Get("expand") != "author" {
+		book.Author = nil
+		return book
+	}
+	expanded, err := withAuthors([]Book{book})
+	if err != nil {
+		log.Printf("%s %s: expanding author: %v", r.Method, r.URL.Path, err)
+		return book
+	}
+	return expanded[0]
+}
+
+// adoptEmbeddedAuthors moves the authors embedded in books saved before
+// authors were a resource of their own into the author store
+func adoptEmbeddedAuthors() error {
+	books, err := store.List()
+	if err != nil {
+		return err
+	}
+	for _, b := range books {
+		if b.AuthorID != "" || b.Author == nil {
+			continue
+		}
+		if err := resolveAuthor(&b); err != nil {
+			return err
+		}
+		if _, err := store.Update(b.ID, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthorEndpoints(t *testing.T) {
+	useStore(t)
+	router := newRouter()
+
+	rec := do(t, router, "POST", "/api/authors", `{"firstname":"Ursula","lastname":"Le Guin"}`)
+	var ursula Author
+	json.NewDecoder(rec.Body).Decode(&ursula)
+	if rec.Code != http.StatusCreated || ursula.ID == "" || rec.Header().Get("Location") != "/api/authors/"+ursula.ID {
+		t.Fatalf("POST /api/authors = %d %+v, Location %q", rec.Code, ursula, rec.Header().Get("Location"))
+	}
+
+	tests := []struct {
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"GET", "/api/authors", "", http.StatusOK},
+		{"GET", "/api/authors/" + ursula.ID, "", http.StatusOK},
+		{"GET", "/api/authors/nobody", "", http.StatusNotFound},
+		{"POST", "/api/authors", `{"firstname":"Nameless"}`, http.StatusUnprocessableEntity},
+		{"PUT", "/api/authors/" + ursula.ID, `{"firstname":"Ursula K.","lastname":"Le Guin"}`, http.StatusOK},
+		{"PUT", "/api/authors/nobody", `{"lastname":"Nobody"}`, http.StatusNotFound},
+		{"POST", "/api/books", `{"title":"The Dispossessed","author_id":"` + ursula.ID + `"}`, http.StatusCreated},
+		{"POST", "/api/books", `{"title":"Orphan","author_id":"nobody"}`, http.StatusUnprocessableEntity},
+		{"GET", "/api/authors/" + ursula.ID + "/books", "", http.StatusOK},
+		{"GET", "/api/authors/nobody/books", "", http.StatusNotFound},
+		{"DELETE", "/api/authors/" + ursula.ID, "", http.StatusConflict},
+		{"DELETE", "/api/authors/nobody", "", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		if rec := do(t, router, tc.method, tc.path, tc.body); rec.Code != tc.wantStatus {
+			t.Errorf("%s %s = %d, want %d (body %s)", tc.method, tc.path, rec.Code, tc.wantStatus, rec.Body)
+		}
+	}
+
+	var p problem
+	json.NewDecoder(do(t, router, "POST", "/api/authors", `{"firstname":"Nameless"}`).Body).Decode(&p)
+	if p.Detail != "the author failed validation" || len(p.Errors) != 1 || p.Errors[0].Field != "lastname" {
+		t.Errorf("invalid author = %+v, want lastname to be what failed", p)
+	}
+
+	if a, _ := store.GetAuthor(ursula.ID); a.Firstname != "Ursula K." {
+		t.Errorf("author after PUT = %+v, want firstname Ursula K.", a)
+	}
+	rec = do(t, router, "GET", "/api/authors/"+ursula.ID+"/books", "")
+	var books []Book
+	json.NewDecoder(rec.Body).Decode(&books)
+	if len(books) != 1 || books[0].Title != "The Dispossessed" {
+		t.Errorf("books of %s = %+v, want The Dispossessed", ursula.ID, books)
+	}
+}
+
+func TestEmbeddedAuthorsAreShared(t *testing.T) {
+	useStore(t)
+	router := newRouter()
+
+	do(t, router, "POST", "/api/books", `{"title":"Book one","author":{"firstname":"John","lastname":"Smith"}}`)
+	do(t, router, "POST", "/api/books", `{"title":"Book two","author":{"firstname":"john","lastname":"SMITH"}}`)
+
+	authors, _ := store.ListAuthors()
+	if len(authors) != 1 {
+		t.Fatalf("stored authors = %+v, want a single John Smith", authors)
+	}
+	books, _ := store.List()
+	for _, b := range books {
+		if b.AuthorID != authors[0].ID || b.Author != nil {
+			t.Errorf("stored book %+v should only refer to author %s", b, authors[0].ID)
+		}
+	}
+}
+
+func TestExpandAuthor(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Firstname: "John", Lastname: "Smith"}})
+	router := newRouter()
+
+	for _, path := range []string{"/api/books/1", "/api/books"} {
+		plain := do(t, router, "GET", path, "").Body.String()
+		if strings.Contains(plain, `"author":`) || !strings.Contains(plain, `"author_id":`) {
+			t.Errorf("GET %s = %s, want author_id only", path, plain)
+		}
+		expanded := do(t, router, "GET", path+"?expand=author", "").Body.String()
+		if !strings.Contains(expanded, `"author":{"id":`) || !strings.Contains(expanded, `"lastname":"Smith"`) {
+			t.Errorf("GET %s?expand=author = %s, want the embedded author", path, expanded)
+		}
+	}
+
+	// filtering by author works without expanding
+	var books []Book
+	json.NewDecoder(do(t, router, "GET", "/api/books?author=smith", "").Body).Decode(&books)
+	if len(books) != 1 {
+		t.Errorf("GET /api/books?author=smith = %+v, want book 1", books)
+	}
+}
+
+func TestExpandedAuthorETag(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Firstname: "John", Lastname: "Smith"}})
+	router := newRouter()
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := editorRequest("GET", path, "")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	plain := get("/api/books/1", "").Header().Get("ETag")
+	expanded := get("/api/books/1?expand=author", "").Header().Get("ETag")
+	if expanded == plain {
+		t.Errorf("expanded and plain answers share the tag %s", plain)
+	}
+	if rec := get("/api/books/1?expand=author", expanded); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match with the expanded tag = %d, want 304", rec.Code)
+	}
+
+	authorID := storedBook(t, "1").AuthorID
+	do(t, router, "PUT", "/api/authors/"+authorID, `{"firstname":"Jon","lastname":"Smith"}`)
+	rec := get("/api/books/1?expand=author", expanded)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"firstname":"Jon"`) {
+		t.Errorf("after renaming the author, If-None-Match with the old tag = %d %s, want 200 with the new name", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("ETag") == expanded {
+		t.Error("renaming the author left the expanded tag as it was")
+	}
+	if rec := get("/api/books/1", plain); rec.Code != http.StatusNotModified {
+		t.Errorf("after renaming the author, the plain answer = %d, want 304: it doesn't show the author", rec.Code)
+	}
+
+	// the expanded tag is as good as the plain one for If-Match
+	req := editorRequest("PUT", "/api/books/1", `{"title":"Renamed","author_id":"`+authorID+`"}`)
+	req.Header.Set("If-Match", rec.Header().Get("ETag"))
+	put := httptest.NewRecorder()
+	router.ServeHTTP(put, req)
+	if put.Code != http.StatusOK {
+		t.Errorf("PUT with the expanded tag = %d %s", put.Code, put.Body)
+	}
+}
+
+func TestPatchEmbeddedAuthorRelinksBook(t *testing.T) {
+	useStore(t,
+		Book{ID: "1", Title: "Sample book", Author: &Author{Firstname: "John", Lastname: "Smith"}},
+		Book{ID: "2", Title: "Sample book 2", Author: &Author{Firstname: "John", Lastname: "Smith"}},
+	)
+	shared := storedBook(t, "2").AuthorID
+
+	req := editorRequest("PATCH", "/api/books/1", `{"author":{"lastname":"Jones"}}`)
+	req.Header.Set("Content-Type", mergePatchType)
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH = %d %s", rec.Code, rec.Body)
+	}
+	if got := storedBook(t, "1").Author; got.ID == shared || got.Firstname != "John" || got.Lastname != "Jones" {
+		t.Errorf("book 1 author = %+v, want a new John Jones", got)
+	}
+	if got := storedBook(t, "2").Author; got.ID != shared || got.Lastname != "Smith" {
+		t.Errorf("book 2 author = %+v, want the untouched John Smith", got)
+	}
+}
+
+func TestFileStoreAdoptsLegacyAuthors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.json")
+	legacy := `[
+		{"id":"1","isbn":"4467899","title":"Sample book","author":{"firstname":"John","lastname":"Smith"}},
+		{"id":"2","isbn":"4465589","title":"Sample book 2","author":{"firstname":"John","lastname":"Smith"}}
+	]`
+	if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	if err := adoptEmbeddedAuthors(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authors, _ := reopened.ListAuthors()
+	books, _ := reopened.List()
+	if len(authors) != 1 || len(books) != 2 {
+		t.Fatalf("reopened store has authors %+v and books %+v, want one author and two books", authors, books)
+	}
+	for _, b := range books {
+		if b.AuthorID != authors[0].ID || b.Author != nil {
+			t.Errorf("book %+v should refer to author %s", b, authors[0].ID)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+// Package bookspb is the generated Go code for the BookService gRPC API
+// described in books.proto.
+package bookspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative books.proto
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	csvType    = "text/csv"
+	ndjsonType = "application/x-ndjson"
+)
+
+// csvColumns are the columns of an export, in order. An import needs a
+// header row naming its columns, in any order; title and either author_id
+// or author_lastname are required. id and version are ignored, and an
+// author_id that isn't known here gives way to the author's names, so an
+// export can be loaded into another catalogue.
+var csvColumns = []string{"id", "isbn", "title", "author_id", "author_firstname", "author_lastname", "version"}
+
+// importRow is one book read from an import, before it is validated
+type importRow struct {
+	line int
+	book Book
+	err  error // the row couldn't be read at all
+}
+
+// importResult reports what happened to one row of an import
+type importResult struct {
+	Line   int              `json:"line"`
+	Status int              `json:"status"` // 201, or the status a POST of this row would have got
+	ID     string           `json:"id,omitempty"`
+	Detail string           `json:"detail,omitempty"`
+	Errors ValidationErrors `json:"errors,omitempty"`
+}
+
+// importReport is the response to an import
+type importReport struct {
+	Created int            `json:"created"`
+	Failed  int            `json:"failed"`
+	Results []importResult `json:"results"`
+}
+
+// importBooks creates a book for every valid row of a CSV or NDJSON body.
+// Rows are independent: a bad row is reported and the rest still go in. The
+// whole body is read before anything is created, so a body that breaks off
+// or is too large imports nothing. Every row is checked first, and the
+// good ones go into the store together, with the authors they name.
+func importBooks(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var rows []importRow
+	var err error
+	switch mediaType {
+	case csvType:
+		rows, err = readCSV(r.Body)
+	case ndjsonType, "application/ndjson":
+		rows, err = readNDJSON(r.Body)
+	default:
+		w.Header().Set("Accept-Post", csvType+", "+ndjsonType)
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "send the books as "+csvType+" or "+ndjsonType)
+		return
+	}
+	if err != nil {
+		badBody(w, r, "readable "+mediaType, err)
+		return
+	}
+
+	results, err := importRows(r, rows)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	report := importReport{Results: results}
+	for _, result := range results {
+		if result.Status == http.StatusCreated {
+			report.Created++
+		} else {
+			report.Failed++
+		}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// importRows checks each row as createBook would, then creates the books
+// of the rows that pass, and the new authors they name, in as few store
+// changes as it can: one, unless an ID the generator came up with turns
+// out to be taken. It only fails if it can't read the authors to start with.
+func importRows(r *http.Request, rows []importRow) ([]importResult, error) {
+	authors, err := store.ListAuthors()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(authors))
+	byName := make(map[string]string, len(authors)) // author ID by lowercased names, as resolveAuthor matches them
+	for _, a := range authors {
+		known[a.ID] = true
+		if key := authorKey(a); byName[key] == "" {
+			byName[key] = a.ID
+		}
+	}
+
+	results := make([]importResult, len(rows))
+	var newAuthors []Author
+	var books []Book
+	var pending []int // the row of each of books
+	for i, row := range rows {
+		results[i].Line = row.line
+		if row.err != nil {
+			results[i].Status = http.StatusBadRequest
+			results[i].Detail = row.err.Error()
+			continue
+		}
+		book := row.book
+		// an export from another catalogue has author IDs this one doesn't
+		// know; the names that come with them are good enough to go by
+		if book.AuthorID != "" && book.Author != nil && book.Author.Lastname != "" && !known[book.AuthorID] {
+			book.AuthorID = ""
+		}
+		if err := book.Validate(); err != nil {
+			results[i].Status = http.StatusUnprocessableEntity
+			results[i].Errors = err.(ValidationErrors)
+			continue
+		}
+		if book.AuthorID == "" && book.Author != nil {
+			key := authorKey(*book.Author)
+			if byName[key] == "" {
+				a := Author{ID: ids.NewID(), Firstname: book.Author.Firstname, Lastname: book.Author.Lastname}
+				newAuthors = append(newAuthors, a)
+				byName[key] = a.ID
+			}
+			book.AuthorID = byName[key]
+		}
+		book.Author = nil
+		book.ID = ids.NewID()
+		book.UpdatedBy = actor(r)
+		books = append(books, book)
+		pending = append(pending, i)
+	}
+
+	for attempt := 0; len(books) > 0; attempt++ {
+		created, errs, err := store.CreateMany(newAuthors, books)
+		if errors.Is(err, ErrDuplicateID) && attempt < 5 {
+			renumberAuthors(newAuthors, books)
+			continue
+		}
+		if err != nil {
+			log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+			for _, i := range pending {
+				results[i].Status = http.StatusInternalServerError
+				results[i].Detail = "the book store failed"
+			}
+			break
+		}
+		newAuthors = nil
+		// books whose ID was taken go round again with a new one
+		var retry []Book
+		var retryRows []int
+		for j, i := range pending {
+			switch err := errs[j]; {
+			case err == nil:
+				results[i].Status = http.StatusCreated
+				results[i].ID = created[j].ID
+			case errors.Is(err, ErrDuplicateID) && attempt < 5:
+				book := books[j]
+				book.ID = ids.NewID()
+				retry = append(retry, book)
+				retryRows = append(retryRows, i)
+			case errors.Is(err, ErrAuthorNotFound):
+				results[i].Status = http.StatusUnprocessableEntity
+				results[i].Errors = ValidationErrors{{Field: "author_id", Message: "no author has this id"}}
+			default:
+				log.Printf("%s %s: line %d: %v", r.Method, r.URL.Path, rows[i].line, err)
+				results[i].Status = http.StatusInternalServerError
+				results[i].Detail = "the book store failed"
+			}
+		}
+		books, pending = retry, retryRows
+	}
+	return results, nil
+}
+
+// authorKey is what authors with the same names, give or take case, share
+func authorKey(a Author) string {
+	return strings.ToLower(a.Firstname) + "\x00" + strings.ToLower(a.Lastname)
+}
+
+// renumberAuthors gives new authors fresh IDs, and the books that name
+// them too
+func renumberAuthors(authors []Author, books []Book) {
+	for i := range authors {
+		old := authors[i].ID
+		authors[i].ID = ids.NewID()
+		for j := range books {
+			if books[j].AuthorID == old {
+				books[j].AuthorID = authors[i].ID
+			}
+		}
+	}
+}
+
+// readCSV reads books from CSV with a header row. A row with the wrong
+// number of fields is reported on its own; broken quoting ends the read.
+func readCSV(body io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(body)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("no header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !contains(csvColumns, name) {
+			return nil, fmt.Errorf("unknown column %q (want %s)", name, strings.Join(csvColumns, ", "))
+		}
+		col[name] = i
+	}
+	if _, ok := col["title"]; !ok {
+		return nil, errors.New("no title column")
+	}
+
+	var rows []importRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		if err != nil {
+			rows = append(rows, importRow{line: line, err: fmt.Errorf("has %d fields, the header has %d", len(record), len(header))})
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := col[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		book := Book{Isbn: field("isbn"), Title: field("title"), AuthorID: field("author_id")}
+		if first, last := field("author_firstname"), field("author_lastname"); book.AuthorID == "" || first != "" || last != "" {
+			book.Author = &Author{Firstname: first, Lastname: last}
+		}
+		rows = append(rows, importRow{line: line, book: book})
+	}
+}
+
+// readNDJSON reads one book per line, as in a POST /api/books body. Blank
+// lines are skipped.
+func readNDJSON(body io.Reader) ([]importRow, error) {
+	var rows []importRow
+	br := bufio.NewReader(body)
+	for line := 1; ; line++ {
+		text, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if text = bytes.TrimSpace(text); len(text) > 0 {
+			var book Book
+			if err := json.Unmarshal(text, &book); err != nil {
+				rows = append(rows, importRow{line: line, err: fmt.Errorf("not a valid book: %v", err)})
+			} else {
+				rows = append(rows, importRow{line: line, book: book})
+			}
+		}
+		if err == io.EOF {
+			return rows, nil
+		}
+	}
+}
+
+// exportPage is how many books an export reads from the store at a time
+var exportPage = 500
+
+// exportStall is how long an export may take to send each page. Every page
+// pushes the write deadline back by this much, so an export can outlast
+// the server's write timeout while a client that stops reading still gets
+// cut off. main sets it to the write timeout; 0 leaves the deadline alone.
+var exportStall time.Duration
+
+// exportBooks streams the catalogue as CSV or NDJSON, a page of books at a
+// time, with each book's author filled in. ?format= picks the format, or
+// failing that the Accept header. Books changed while an export runs can
+// shift between pages, so such an export may miss or repeat one.
+func exportBooks(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		// versionedRoute has already answered a request accepting neither
+		format = "csv"
+		if negotiate(r.Header.Get("Accept"), exportTypes) == ndjsonType {
+			format = "ndjson"
+		}
+	}
+	if format != "csv" && format != "ndjson" {
+		writeProblem(w, r, http.StatusBadRequest, "format must be csv or ndjson")
+		return
+	}
+	// the first page is read before answering, so a failing store still
+	// gets a proper error
+	books, err := store.Page(0, exportPage)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	authors, err := store.ListAuthors()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	byID := make(map[string]Author, len(authors))
+	for _, a := range authors {
+		byID[a.ID] = a
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="books.`+format+`"`)
+	if format == "csv" {
+		w.Header().Set("Content-Type", csvType+"; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", ndjsonType)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	cw := csv.NewWriter(w)
+	enc := json.NewEncoder(w)
+	if format == "csv" {
+		cw.Write(csvColumns)
+	}
+	for offset := 0; ; {
+		if exportStall > 0 {
+			extendWriteDeadline(r, exportStall)
+		}
+		for _, b := range books {
+			a, ok := byID[b.AuthorID]
+			if !ok && b.AuthorID != "" {
+				// an author added since the export started
+				if a, err = store.GetAuthor(b.AuthorID); err == nil {
+					byID[a.ID], ok = a, true
+				}
+			}
+			if ok {
+				b.Author = &a
+			}
+			if format == "csv" {
+				err = cw.Write(csvRecord(b))
+			} else {
+				err = enc.Encode(b)
+			}
+			if err != nil {
+				return // the client has gone
+			}
+		}
+		// hand the client each page instead of buffering it all
+		cw.Flush()
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if len(books) < exportPage {
+			return
+		}
+		offset += len(books)
+		if books, err = store.Page(offset, exportPage); err != nil {
+			// too late for an error response; the client gets a short file
+			log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+			return
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// csvRecord is book as a row under csvColumns; its author's names are
+// only filled in if book.Author is
+func csvRecord(b Book) []string {
+	var first, last string
+	if b.Author != nil {
+		first, last = b.Author.Firstname, b.Author.Lastname
+	}
+	return []string{b.ID, b.Isbn, b.Title, b.AuthorID, first, last, strconv.Itoa(b.Version)}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// responses caches the answers to book list and single-book reads; nil,
+// the default, caches nothing. main sets it up from the config.
+var responses *responseCache
+
+// clientMaxAge is how long clients may reuse a cacheable read before they
+// check back; 0 has them check back every time
+var clientMaxAge time.Duration
+
+var cacheLookups = newMetricVec("books_response_cache_lookups_total", "counter",
+	"Cacheable reads, by whether they were answered from the response cache.", "result")
+
+// cache tags: every list of books depends on listTag, and a single book's
+// answer on bookTag(id)
+const listTag = "books"
+
+func bookTag(id string) string { return "book:" + id }
+
+// responseCache is an LRU cache of whole responses, bounded by the bytes
+// of their bodies. Entries expire after ttl, and are dropped as soon as a
+// write touches what they depend on: each carries tags, and invalidate
+// removes every entry with a given tag.
+type responseCache struct {
+	ttl      time.Duration
+	maxBytes int
+	now      func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List               // of *cachedResponse, most recently used first
+	entries map[string]*list.Element // by key
+	tagged  map[string]map[string]bool
+	bytes   int
+	gen     uint64 // bumped by every invalidation
+}
+
+type cachedResponse struct {
+	key     string
+	tags    []string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func newResponseCache(ttl time.Duration, maxBytes int) *responseCache {
+	return &responseCache{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		now:      time.Now,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		tagged:   map[string]map[string]bool{},
+	}
+}
+
+// get returns the live entry for key, if there is one
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cachedResponse)
+	if !c.now().Before(e.expires) {
+		c.remove(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// generation is taken before computing a response to put in the cache
+func (c *responseCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// put adds e unless something has been invalidated since gen, in which
+// case e may already be out of date. The least recently used entries make
+// way for it if the cache is full.
+func (c *responseCache) put(e *cachedResponse, gen uint64) {
+	if len(e.body) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	e.stored = c.now()
+	e.expires = e.stored.Add(c.ttl)
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.bytes += len(e.body)
+	for _, t := range e.tags {
+		if c.tagged[t] == nil {
+			c.tagged[t] = map[string]bool{}
+		}
+		c.tagged[t][e.key] = true
+	}
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate drops every entry carrying any of tags
+func (c *responseCache) invalidate(tags ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, t := range tags {
+		for key := range c.tagged[t] {
+			c.remove(c.entries[key])
+		}
+	}
+}
+
+// reset drops every entry
+func (c *responseCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *responseCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cachedResponse)
+	delete(c.entries, e.key)
+	c.bytes -= len(e.body)
+	for _, t := range e.tags {
+		delete(c.tagged[t], e.key)
+		if len(c.tagged[t]) == 0 {
+			delete(c.tagged, t)
+		}
+	}
+}
+
+func (c *responseCache) size() (entries, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.bytes
+}
+
+// cachedHeaders are the response headers stored with a cached body
+var cachedHeaders = []string{"Content-Type", "ETag", "Link", "X-Total-Count", "Vary"}
+
+// cached answers GETs of h from the response cache when it can, and
+// stores h's 200 answers there under the tag of what they depend on. Requests
+// are told how long they may keep the answer with Cache-Control. A hit
+// costs next to nothing, so it doesn't count against the rate limit.
+// Conditional requests are left to h, which knows the ETags.
+func cached(tag func(*http.Request) string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", cacheControl())
+		c := responses
+		if c == nil || r.Header.Get("If-None-Match") != "" {
+			h(w, r)
+			return
+		}
+		// the representation depends on the path (and so the version), the
+		// query and what the client accepts
+		key := r.URL.Path + "?" + r.URL.Query().Encode() + "|" + r.Header.Get("Accept")
+		if e := c.get(key); e != nil {
+			cacheLookups.add(1, "hit")
+			for name, values := range e.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Age", strconv.Itoa(int(c.now().Sub(e.stored).Seconds())))
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+		cacheLookups.add(1, "miss")
+
+		gen := c.generation()
+		rec := &teeResponse{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		if rec.status != http.StatusOK {
+			return
+		}
+		e := &cachedResponse{key: key, tags: []string{tag(r)}, status: rec.status, header: http.Header{}, body: rec.body.Bytes()}
+		for _, name := range cachedHeaders {
+			if values := w.Header().Values(name); len(values) > 0 {
+				e.header[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+		c.put(e, gen)
+	}
+}
+
+func listTagOf(*http.Request) string { return listTag }
+
+func bookTagOf(r *http.Request) string { return bookTag(mux.Vars(r)["id"]) }
+
+func cacheControl() string {
+	if clientMaxAge <= 0 {
+		return "no-cache"
+	}
+	return "public, max-age=" + strconv.Itoa(int(clientMaxAge.Seconds()))
+}
+
+// teeResponse sends a response on and keeps a copy of its body
+type teeResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (t *teeResponse) WriteHeader(status int) {
+	t.status = status
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *teeResponse) Write(p []byte) (int, error) {
+	t.body.Write(p)
+	return t.ResponseWriter.Write(p)
+}
+
+// invalidatingStore is a BookStore that drops the cached responses each
+// change it makes could have made out of date
+type invalidatingStore struct {
+	BookStore
+	cache *responseCache
+}
+
+// invalidateResponses wraps s so changes made through it invalidate c
+func invalidateResponses(s BookStore, c *responseCache) BookStore {
+	return invalidatingStore{s, c}
+}
+
+// Ping passes readiness checks through to the wrapped store
+func (s invalidatingStore) Ping() error {
+	if p, ok := s.BookStore.(pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+func (s invalidatingStore) Create(book Book) (Book, error) {
+	created, err := s.BookStore.Create(book)
+	if err == nil {
+		s.cache.invalidate(listTag)
+	}
+	return created, err
+}
+
+func (s invalidatingStore) CreateMany(authors []Author, books []Book) ([]Book, []error, error) {
+	created, errs, err := s.BookStore.CreateMany(authors, books)
+	if err == nil {
+		s.cache.invalidate(listTag)
+	}
+	return created, errs, err
+}
+
+func (s invalidatingStore) Update(id string, book Book) (Book, error) {
+	updated, err := s.BookStore.Update(id, book)
+	if err == nil {
+		s.cache.invalidate(listTag, bookTag(id))
+	}
+	return updated, err
+}
+
+func (s invalidatingStore) Delete(id string, version int, by string) error {
+	err := s.BookStore.Delete(id, version, by)
+	if err == nil {
+		s.cache.invalidate(listTag, bookTag(id))
+	}
+	return err
+}
+
+func (s invalidatingStore) Undelete(id, by string) (Book, error) {
+	book, err := s.BookStore.Undelete(id, by)
+	if err == nil {
+		s.cache.invalidate(listTag, bookTag(id))
+	}
+	return book, err
+}
+
+// UpdateAuthor invalidates the author's books too: their answers embed the
+// author for ?expand=author, in v2 and as CSV
+func (s invalidatingStore) UpdateAuthor(id string, author Author) (Author, error) {
+	updated, err := s.BookStore.UpdateAuthor(id, author)
+	if err != nil {
+		return updated, err
+	}
+	books, err := s.BookStore.List()
+	if err != nil {
+		s.cache.reset() // can't tell which books are the author's
+		return updated, nil
+	}
+	tags := []string{listTag}
+	for _, b := range books {
+		if b.AuthorID == id {
+			tags = append(tags, bookTag(b.ID))
+		}
+	}
+	s.cache.invalidate(tags...)
+	return updated, nil
+}
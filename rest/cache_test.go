@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useCache caches responses for the rest of the test, with the package
+// store invalidating them. It returns the store underneath, for changes
+// the cache shouldn't hear about.
+func useCache(t *testing.T, ttl time.Duration) BookStore {
+	t.Helper()
+	underlying := store
+	responses = newResponseCache(ttl, 1<<20)
+	store = invalidateResponses(store, responses)
+	t.Cleanup(func() { responses = nil })
+	return underlying
+}
+
+func TestResponseCache(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newResponseCache(time.Minute, 10)
+	c.now = func() time.Time { return now }
+	entry := func(key, body string, tags ...string) *cachedResponse {
+		return &cachedResponse{key: key, tags: tags, status: http.StatusOK, body: []byte(body)}
+	}
+
+	c.put(entry("a", "aaaa", "x"), c.generation())
+	c.put(entry("b", "bbbb", "y"), c.generation())
+	c.get("a") // a is now the most recently used
+	c.put(entry("c", "cccc", "y"), c.generation())
+	if c.get("b") != nil || c.get("a") == nil || c.get("c") == nil {
+		t.Error("adding c to a full cache didn't evict b, the least recently used")
+	}
+	if n, size := c.size(); n != 2 || size != 8 {
+		t.Errorf("size = %d entries, %d bytes, want 2 and 8", n, size)
+	}
+	c.put(entry("huge", "0123456789a"), c.generation())
+	if c.get("huge") != nil || c.get("a") == nil {
+		t.Error("an entry bigger than the whole cache was stored")
+	}
+
+	c.invalidate("y")
+	if c.get("c") != nil || c.get("a") == nil {
+		t.Error("invalidating y should drop c and only c")
+	}
+
+	// a response computed before an invalidation may already be stale
+	gen := c.generation()
+	c.invalidate("z")
+	c.put(entry("d", "dd", "z"), gen)
+	if c.get("d") != nil {
+		t.Error("stored a response computed before an invalidation")
+	}
+
+	now = now.Add(time.Minute)
+	if c.get("a") != nil {
+		t.Error("a outlived its TTL")
+	}
+	if n, size := c.size(); n != 0 || size != 0 {
+		t.Errorf("size after expiry = %d entries, %d bytes", n, size)
+	}
+}
+
+func TestCachedBookReads(t *testing.T) {
+	useStore(t,
+		Book{ID: "1", Title: "Go in Action", Author: &Author{Firstname: "Bill", Lastname: "Kennedy"}},
+		Book{ID: "2", Title: "Concurrency in Go", Author: &Author{Firstname: "Katherine", Lastname: "Cox-Buday"}},
+	)
+	underlying := useCache(t, time.Minute)
+	router := newRouter()
+	title := func(path string) string {
+		t.Helper()
+		var b bookV2
+		rec := do(t, router, "GET", path, "")
+		if err := json.NewDecoder(rec.Body).Decode(&b); err != nil {
+			t.Fatalf("GET %s: %d %v", path, rec.Code, err)
+		}
+		return b.Title
+	}
+	sneak := func(id, title string) {
+		b, _ := underlying.Get(id)
+		b.Title = title
+		if _, err := underlying.Update(id, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := do(t, router, "GET", "/api/books/1", "")
+	if rec.Header().Get("Age") != "" || rec.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("first read: Age %q, Cache-Control %q", rec.Header().Get("Age"), rec.Header().Get("Cache-Control"))
+	}
+	sneak("1", "Go in Action, 2nd ed.")
+	rec = do(t, router, "GET", "/api/books/1", "")
+	if rec.Header().Get("Age") != "0" || rec.Header().Get("ETag") != `"1"` || !strings.Contains(rec.Body.String(), `"Go in Action"`) {
+		t.Errorf("second read wasn't the cached one: Age %q, ETag %q, %s", rec.Header().Get("Age"), rec.Header().Get("ETag"), rec.Body)
+	}
+	if got := title("/api/v2/books/1"); got != "Go in Action, 2nd ed." {
+		t.Errorf("v2 read = %q, want its own cache entry", got)
+	}
+
+	// writes through the API invalidate what they change
+	do(t, router, "GET", "/api/books?sort=title", "")
+	title("/api/books/2")
+	if rec := do(t, router, "PUT", "/api/books/1", `{"title":"Go in Action, 3rd ed.","author_id":"`+storedBook(t, "1").AuthorID+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("PUT = %d %s", rec.Code, rec.Body)
+	}
+	if got := title("/api/books/1"); got != "Go in Action, 3rd ed." {
+		t.Errorf("after PUT, read %q", got)
+	}
+	var list []Book
+	json.NewDecoder(do(t, router, "GET", "/api/books?sort=title", "").Body).Decode(&list)
+	if len(list) != 2 || list[1].Title != "Go in Action, 3rd ed." {
+		t.Errorf("after PUT, list = %+v", list)
+	}
+	sneak("2", "Sneaked")
+	if got := title("/api/books/2"); got != "Concurrency in Go" {
+		t.Errorf("PUT of book 1 invalidated book 2: read %q", got)
+	}
+
+	do(t, router, "POST", "/api/books", `{"title":"Go Web Programming","author":{"lastname":"Chang"}}`)
+	if rec := do(t, router, "GET", "/api/books?sort=title", ""); rec.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("after POST, X-Total-Count = %q", rec.Header().Get("X-Total-Count"))
+	}
+
+	do(t, router, "DELETE", "/api/books/1", "")
+	if rec := do(t, router, "GET", "/api/books/1", ""); rec.Code != http.StatusGone {
+		t.Errorf("after DELETE, read = %d", rec.Code)
+	}
+
+	// renaming an author changes the books that embed them
+	authorID := storedBook(t, "2").AuthorID
+	title("/api/v2/books/2")
+	do(t, router, "PUT", "/api/authors/"+authorID, `{"firstname":"Katherine","lastname":"Cox"}`)
+	var b bookV2
+	json.NewDecoder(do(t, router, "GET", "/api/v2/books/2", "").Body).Decode(&b)
+	if b.Author == nil || b.Author.Lastname != "Cox" {
+		t.Errorf("after renaming the author, v2 book = %+v", b)
+	}
+}
+
+func TestCachedReadsLeaveConditionalRequests(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Go in Action", Author: &Author{Lastname: "Kennedy"}})
+	useCache(t, time.Minute)
+	saved := clientMaxAge
+	defer func() { clientMaxAge = saved }()
+	clientMaxAge = 90 * time.Second
+	router := newRouter()
+
+	do(t, router, "GET", "/api/books/1", "")
+	req := editorRequest("GET", "/api/books/1", "")
+	req.Header.Set("If-None-Match", `"1"`)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match with the current ETag = %d, want 304", rec.Code)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "public, max-age=90" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+}
+
+func TestReadyzWithCache(t *testing.T) {
+	fs, err := newFileStore(filepath.Join(t.TempDir(), "missing", "books.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses = newResponseCache(time.Minute, 1<<20)
+	defer func() { responses = nil }()
+	store = wrapStore(fs, responses)
+	defer useStore(t)
+
+	if rec := do(t, newRouter(), "GET", "/readyz", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz without a data directory, with the cache on = %d, want 503", rec.Code)
+	}
+}
+
+func TestEventHandlersReadTheChange(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Go in Action", Author: &Author{Lastname: "Kennedy"}})
+	responses = newResponseCache(time.Minute, 1<<20)
+	defer func() { responses = nil }()
+	store = wrapStore(store, responses)
+	router := newRouter()
+	authorID := storedBook(t, "1").AuthorID
+	do(t, router, "GET", "/api/books/1", "") // cache the book as it is
+	ch, cancel := events.subscribe(1)
+	defer cancel()
+
+	// hold up the cache, so an event published before the cached book is
+	// dropped gets here first
+	responses.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		do(t, router, "PUT", "/api/books/1", `{"title":"Go in Action, 2nd ed.","author_id":"`+authorID+`"}`)
+		close(done)
+	}()
+	var e Event
+	select {
+	case e = <-ch:
+		t.Errorf("%s was published before the cached book was dropped", e.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+	responses.mu.Unlock()
+	if e.ID == "" {
+		select {
+		case e = <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("no event for the PUT")
+		}
+	}
+
+	// what a handler that reads the book back on hearing of it gets
+	var b Book
+	json.NewDecoder(do(t, router, "GET", "/api/books/1", "").Body).Decode(&b)
+	if b.Title != e.Book.Title {
+		t.Errorf("read back %q after the %s event for %q", b.Title, e.Type, e.Book.Title)
+	}
+	<-done
+}
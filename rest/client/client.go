@@ -0,0 +1,257 @@
+// Package client is a Go client for the books API.
+//
+//	c, err := client.New("https://books.example.com", client.WithAPIKey(key))
+//	book, err := c.GetBook(ctx, "42")
+//	if errors.Is(err, client.ErrNotFound) { ... }
+//
+// Reads, replacements and deletes are retried when the server is briefly
+// unavailable or rate limits the client; creates are not, as a retried
+// create could make the book twice.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rest/model"
+)
+
+// Client calls the books API. It is safe for concurrent use.
+type Client struct {
+	base    *url.URL
+	http    *http.Client
+	apiKey  string
+	token   string
+	retries int           // extra attempts for idempotent calls
+	backoff time.Duration // wait before the first retry, doubled for each one after
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sends requests through hc instead of a default client
+// with a 30 second timeout
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithAPIKey authenticates with an API key, sent as X-API-Key
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithBearerToken authenticates with a JWT, sent as a bearer token
+func WithBearerToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithRetries sets how many times an idempotent call is tried again (3 by
+// default) and how long to wait before the first retry (200ms by default).
+// A Retry-After from the server takes precedence over the backoff.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = retries, backoff }
+}
+
+// New returns a client for the API at baseURL, such as
+// "https://books.example.com"
+func New(baseURL string, opts ...Option) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("client: base URL %q is not http or https", baseURL)
+	}
+	c := &Client{
+		base:    base,
+		http:    &http.Client{Timeout: 30 * time.Second},
+		retries: 3,
+		backoff: 200 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// ListOptions filters, sorts and pages ListBooks. Zero values leave the
+// server's defaults.
+type ListOptions struct {
+	Limit        int
+	Offset       int
+	Author       string // author last name, case-insensitive
+	Title        string // substring of the title, case-insensitive
+	ISBN         string
+	Sort         string // id, title or isbn; prefix with - for descending
+	ExpandAuthor bool   // fill in each book's Author
+}
+
+// Page is one page of books and the number of books on all pages
+type Page struct {
+	Books []model.Book
+	Total int
+}
+
+// ListBooks returns a page of books
+func (c *Client) ListBooks(ctx context.Context, opts ListOptions) (Page, error) {
+	q := url.Values{}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		q.Set("offset", strconv.Itoa(opts.Offset))
+	}
+	for name, v := range map[string]string{"author": opts.Author, "title": opts.Title, "isbn": opts.ISBN, "sort": opts.Sort} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	if opts.ExpandAuthor {
+		q.Set("expand", "author")
+	}
+	var page Page
+	resp, err := c.do(ctx, "GET", "/api/v1/books", q, nil, nil, &page.Books)
+	if err != nil {
+		return Page{}, err
+	}
+	page.Total, _ = strconv.Atoi(resp.Header.Get("X-Total-Count"))
+	return page, nil
+}
+
+// GetBook returns the book with the given ID, with its author filled in
+func (c *Client) GetBook(ctx context.Context, id string) (model.Book, error) {
+	var book model.Book
+	_, err := c.do(ctx, "GET", "/api/v1/books/"+url.PathEscape(id), expand, nil, nil, &book)
+	return book, err
+}
+
+// CreateBook stores a new book and returns it as stored, with its ID. The
+// book names its author with AuthorID or embeds one in Author. It is never
+// retried.
+func (c *Client) CreateBook(ctx context.Context, book model.Book) (model.Book, error) {
+	var created model.Book
+	_, err := c.do(ctx, "POST", "/api/v1/books", expand, nil, book, &created)
+	return created, err
+}
+
+// UpdateBook replaces the book with book.ID. If book.Version is set the
+// update only goes through if the stored book is still at that version,
+// failing with ErrPreconditionFailed otherwise.
+func (c *Client) UpdateBook(ctx context.Context, book model.Book) (model.Book, error) {
+	var updated model.Book
+	_, err := c.do(ctx, "PUT", "/api/v1/books/"+url.PathEscape(book.ID), expand, ifMatch(book.Version), book, &updated)
+	return updated, err
+}
+
+// DeleteBook deletes the book with the given ID. A version other than 0
+// makes the delete conditional, as for UpdateBook.
+func (c *Client) DeleteBook(ctx context.Context, id string, version int) error {
+	_, err := c.do(ctx, "DELETE", "/api/v1/books/"+url.PathEscape(id), nil, ifMatch(version), nil, nil)
+	return err
+}
+
+// expand asks for books with their author filled in
+var expand = url.Values{"expand": {"author"}}
+
+func ifMatch(version int) http.Header {
+	if version == 0 {
+		return nil
+	}
+	return http.Header{"If-Match": {strconv.Quote(strconv.Itoa(version))}}
+}
+
+// do sends a request, retrying idempotent ones, and decodes a successful
+// JSON response into out. Error responses come back as *Error.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, in, out interface{}) (*http.Response, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
+	}
+	u := *c.base
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	attempts := 1
+	if method != "POST" && method != "PATCH" {
+		attempts += c.retries
+	}
+	wait := c.backoff
+	for attempt := 1; ; attempt++ {
+		resp, err := c.send(ctx, method, u.String(), header, body)
+		if err == nil && resp.StatusCode < 400 {
+			defer resp.Body.Close()
+			if out != nil && resp.StatusCode != http.StatusNoContent {
+				if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+					return resp, fmt.Errorf("client: decoding %s %s: %w", method, path, err)
+				}
+			}
+			return resp, nil
+		}
+		if err == nil {
+			err = readError(resp)
+		}
+		if attempt == attempts || !retryable(err) || ctx.Err() != nil {
+			return resp, err
+		}
+		delay := wait/2 + time.Duration(rand.Int63n(int64(wait)/2+1))
+		if e, ok := err.(*Error); ok && e.RetryAfter > 0 {
+			delay = e.RetryAfter
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, u string, header http.Header, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.http.Do(req)
+}
+
+// retryable is true for network errors and for answers that say to come
+// back later
+func retryable(err error) bool {
+	if e, ok := err.(*Error); ok {
+		switch e.Status {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rest/model"
+)
+
+// flaky answers each request with the next status in statuses, then 200
+// with an empty JSON object, counting the requests it gets
+func flaky(t *testing.T, statuses ...int) (*Client, *int32) {
+	t.Helper()
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if int(n) <= len(statuses) {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(statuses[n-1])
+			w.Write([]byte(`{"title":"try later"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"1","title":"Sample book"}`))
+	}))
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL, WithRetries(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, &calls
+}
+
+func TestRetriesIdempotentCalls(t *testing.T) {
+	c, calls := flaky(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	book, err := c.GetBook(context.Background(), "1")
+	if err != nil || book.Title != "Sample book" {
+		t.Fatalf("GetBook = %+v, %v, want the book after two retries", book, err)
+	}
+	if *calls != 3 {
+		t.Errorf("%d requests, want 3", *calls)
+	}
+
+	c, calls = flaky(t, http.StatusBadGateway)
+	if _, err := c.UpdateBook(context.Background(), model.Book{ID: "1"}); err != nil || *calls != 2 {
+		t.Errorf("UpdateBook = %v after %d requests, want success on the second", err, *calls)
+	}
+}
+
+func TestGivesUpAfterRetries(t *testing.T) {
+	c, calls := flaky(t, 503, 503, 503, 503, 503)
+	err := c.DeleteBook(context.Background(), "1", 0)
+	if !errors.Is(err, &Error{Status: http.StatusServiceUnavailable}) || *calls != 4 {
+		t.Errorf("DeleteBook = %v after %d requests, want a 503 after 4", err, *calls)
+	}
+}
+
+func TestDoesNotRetryCreatesOrClientErrors(t *testing.T) {
+	c, calls := flaky(t, http.StatusServiceUnavailable)
+	if _, err := c.CreateBook(context.Background(), model.Book{Title: "New"}); err == nil || *calls != 1 {
+		t.Errorf("CreateBook = %v after %d requests, want the 503 straight away", err, *calls)
+	}
+
+	c, calls = flaky(t, http.StatusNotFound)
+	if _, err := c.GetBook(context.Background(), "1"); !errors.Is(err, ErrNotFound) || *calls != 1 {
+		t.Errorf("GetBook = %v after %d requests, want ErrNotFound straight away", err, *calls)
+	}
+}
+
+func TestStopsRetryingWhenContextEnds(t *testing.T) {
+	c, _ := flaky(t, 503, 503, 503, 503)
+	c.backoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetBook(ctx, "1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetBook = %v, want the context's deadline", err)
+	}
+}
+
+func TestErrorFromNonProblemBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "req-1")
+		w.Header().Set("Retry-After", "7")
+		http.Error(w, "upstream exploded", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	c, _ := New(srv.URL, WithRetries(0, 0))
+
+	_, err := c.GetBook(context.Background(), "1")
+	var e *Error
+	if !errors.As(err, &e) || e.Status != 502 || e.Title != "Bad Gateway" || e.RequestID != "req-1" || e.RetryAfter != 7*time.Second {
+		t.Errorf("error = %#v, want a 502 with the request ID and Retry-After", err)
+	}
+}
+
+func TestNewRejectsBadBaseURLs(t *testing.T) {
+	for _, u := range []string{"books.example.com", "ftp://books.example.com", ":"} {
+		if _, err := New(u); err == nil {
+			t.Errorf("New(%q) = nil error, want error", u)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rest/model"
+)
+
+// Sentinels to check an *Error against with errors.Is
+var (
+	ErrBadRequest         = &Error{Status: http.StatusBadRequest}
+	ErrUnauthorized       = &Error{Status: http.StatusUnauthorized}
+	ErrForbidden          = &Error{Status: http.StatusForbidden}
+	ErrNotFound           = &Error{Status: http.StatusNotFound}
+	ErrConflict           = &Error{Status: http.StatusConflict}
+	ErrGone               = &Error{Status: http.StatusGone}
+	ErrPreconditionFailed = &Error{Status: http.StatusPreconditionFailed}
+	ErrInvalid            = &Error{Status: http.StatusUnprocessableEntity}
+	ErrRateLimited        = &Error{Status: http.StatusTooManyRequests}
+)
+
+// Error is a failed call, built from the API's RFC 7807 problem response
+type Error struct {
+	Status   int                    `json:"status"`
+	Type     string                 `json:"type"`
+	Title    string                 `json:"title"`
+	Detail   string                 `json:"detail"`
+	Instance string                 `json:"instance"`
+	Errors   model.ValidationErrors `json:"errors"` // the invalid fields, for ErrInvalid
+
+	RequestID  string        `json:"-"` // for looking the request up in the server's logs
+	RetryAfter time.Duration `json:"-"` // how long the server asked us to wait, if it did
+}
+
+func (e *Error) Error() string {
+	msg := "books api: " + strconv.Itoa(e.Status) + " " + e.Title
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if len(e.Errors) > 0 {
+		msg += " (" + e.Errors.Error() + ")"
+	}
+	return msg
+}
+
+// Is matches the sentinel errors by status, so errors.Is(err, ErrNotFound)
+// holds for any 404
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Status == e.Status
+}
+
+// readError turns a failed response into an *Error, falling back on the
+// status line when the body isn't a problem
+func readError(resp *http.Response) error {
+	defer resp.Body.Close()
+	e := &Error{}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	json.Unmarshal(data, e)
+	e.Status = resp.StatusCode
+	if e.Title == "" {
+		e.Title = http.StatusText(resp.StatusCode)
+	}
+	e.RequestID = resp.Header.Get("X-Request-ID")
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
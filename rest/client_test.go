@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rest/client"
+)
+
+// newTestClient serves the real router, behind the middleware, and returns
+// a client for it with the given options
+func newTestClient(t *testing.T, opts ...client.Option) *client.Client {
+	t.Helper()
+	srv := httptest.NewServer(withMiddleware(newRouter(), config{}))
+	t.Cleanup(srv.Close)
+	c, err := client.New(srv.URL, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientAgainstRouter(t *testing.T) {
+	useStore(t, sampleBooks...)
+	c := newTestClient(t, client.WithAPIKey(testAPIKey))
+	ctx := context.Background()
+
+	page, err := c.ListBooks(ctx, client.ListOptions{Title: "go", Limit: 2, Sort: "-title", ExpandAuthor: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.Books) != 2 || page.Books[0].ID != "1" || page.Books[0].Author == nil {
+		t.Fatalf("ListBooks = %+v, want 2 of 3 Go books, best title first, with authors", page)
+	}
+
+	created, err := c.CreateBook(ctx, Book{Title: "Go in Practice", Isbn: "9781633430075", Author: &Author{Firstname: "Matt", Lastname: "Butcher"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.Version != 1 || created.Author == nil || created.Author.Lastname != "Butcher" {
+		t.Fatalf("CreateBook = %+v, want a new book at version 1 with its author", created)
+	}
+
+	got, err := c.GetBook(ctx, created.ID)
+	if err != nil || got.Title != "Go in Practice" {
+		t.Fatalf("GetBook = %+v, %v", got, err)
+	}
+	got.Title = "Go in Practice, 2nd edition"
+	updated, err := c.UpdateBook(ctx, got)
+	if err != nil || updated.Version != 2 || updated.Title != got.Title {
+		t.Fatalf("UpdateBook = %+v, %v, want version 2 with the new title", updated, err)
+	}
+
+	// got is now a version behind
+	if _, err := c.UpdateBook(ctx, got); !errors.Is(err, client.ErrPreconditionFailed) {
+		t.Errorf("UpdateBook at a stale version: error = %v, want ErrPreconditionFailed", err)
+	}
+	if err := c.DeleteBook(ctx, created.ID, 1); !errors.Is(err, client.ErrPreconditionFailed) {
+		t.Errorf("DeleteBook at a stale version: error = %v, want ErrPreconditionFailed", err)
+	}
+	if err := c.DeleteBook(ctx, created.ID, updated.Version); err != nil {
+		t.Fatalf("DeleteBook: %v", err)
+	}
+	if _, err := c.GetBook(ctx, created.ID); !errors.Is(err, client.ErrGone) {
+		t.Errorf("GetBook after DeleteBook: error = %v, want ErrGone", err)
+	}
+	if _, err := c.GetBook(ctx, "no-such-book"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("GetBook of an unknown ID: error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestClientValidationErrors(t *testing.T) {
+	useStore(t)
+	c := newTestClient(t, client.WithAPIKey(testAPIKey))
+
+	_, err := c.CreateBook(context.Background(), Book{Title: "Go", Isbn: "123", Author: &Author{Firstname: "Rob"}})
+	var e *client.Error
+	if !errors.As(err, &e) || !errors.Is(err, client.ErrInvalid) {
+		t.Fatalf("CreateBook of an invalid book: error = %v, want ErrInvalid", err)
+	}
+	if len(e.Errors) != 2 || e.Errors[0].Field != "isbn" || e.Errors[1].Field != "author.lastname" {
+		t.Errorf("field errors = %+v, want isbn and author.lastname", e.Errors)
+	}
+	if e.RequestID == "" || e.Instance != "/api/v1/books" {
+		t.Errorf("error = %+v, want the request ID and instance filled in", e)
+	}
+}
+
+func TestClientNeedsCredentialsToWrite(t *testing.T) {
+	useStore(t)
+	c := newTestClient(t)
+	if _, err := c.CreateBook(context.Background(), Book{Title: "Go", Author: &Author{Lastname: "Pike"}}); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("anonymous CreateBook: error = %v, want ErrUnauthorized", err)
+	}
+
+	token := signJWT("HS256", "secret", map[string]interface{}{"sub": "reader", "roles": []string{"reader"}, "exp": 4102444800})
+	saved := auth
+	defer func() { auth = saved }()
+	auth, _ = newAuthenticator("secret", "")
+	c = newTestClient(t, client.WithBearerToken(token))
+	if _, err := c.CreateBook(context.Background(), Book{Title: "Go", Author: &Author{Lastname: "Pike"}}); !errors.Is(err, client.ErrForbidden) {
+		t.Errorf("CreateBook as a reader: error = %v, want ErrForbidden", err)
+	}
+}
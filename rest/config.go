@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is everything the server can be told at startup. Each setting is
+// a flag, and an environment variable named in the flag's usage provides
+// its default, so flags win over the environment.
+type config struct {
+	addr     string
+	grpcAddr string
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+
+	store    string
+	dataFile string
+	ids      string
+
+	corsOrigins []string
+
+	jwtSecret string
+	apiKeys   string
+
+	readLimit  rateSpec
+	writeLimit rateSpec
+	maxBody    int64
+
+	retention     time.Duration
+	purgeInterval time.Duration
+
+	webhooks      []string
+	webhookSecret string
+
+	cacheTTL    time.Duration
+	cacheBytes  int
+	cacheMaxAge time.Duration
+
+	idempotencyWindow time.Duration
+}
+
+// loadConfig reads the configuration from args (without the program name)
+// and the environment, as looked up by getenv
+func loadConfig(args []string, getenv func(string) string) (config, error) {
+	var cfg config
+	fs := flag.NewFlagSet("rest", flag.ContinueOnError)
+
+	var envErrs []string
+	str := func(p *string, name, env, value, usage string) {
+		if v := getenv(env); v != "" {
+			value = v
+		}
+		fs.StringVar(p, name, value, fmt.Sprintf("%s (env %s)", usage, env))
+	}
+	num := func(p *float64, name, env string, value float64, usage string) {
+		if v := getenv(env); v != "" {
+			if f, err := strconv.ParseFloat(v, 64); err != nil {
+				envErrs = append(envErrs, fmt.Sprintf("%s: %v", env, err))
+			} else {
+				value = f
+			}
+		}
+		fs.Float64Var(p, name, value, fmt.Sprintf("%s (env %s)", usage, env))
+	}
+	integer := func(p *int, name, env string, value int, usage string) {
+		if v := getenv(env); v != "" {
+			if n, err := strconv.Atoi(v); err != nil {
+				envErrs = append(envErrs, fmt.Sprintf("%s: %v", env, err))
+			} else {
+				value = n
+			}
+		}
+		fs.IntVar(p, name, value, fmt.Sprintf("%s (env %s)", usage, env))
+	}
+	dur := func(p *time.Duration, name, env string, value time.Duration, usage string) {
+		if v := getenv(env); v != "" {
+			if d, err := time.ParseDuration(v); err != nil {
+				envErrs = append(envErrs, fmt.Sprintf("%s: %v", env, err))
+			} else {
+				value = d
+			}
+		}
+		fs.DurationVar(p, name, value, fmt.Sprintf("%s (env %s)", usage, env))
+	}
+
+	str(&cfg.addr, "addr", "BOOKS_ADDR", ":8000", "address to listen on")
+	str(&cfg.grpcAddr, "grpc-addr", "BOOKS_GRPC_ADDR", "", "address for the gRPC BookService to listen on, e.g. :9090; empty to not serve it")
+	dur(&cfg.readHeaderTimeout, "read-header-timeout", "BOOKS_READ_HEADER_TIMEOUT", 5*time.Second, "time allowed to read request headers")
+	dur(&cfg.readTimeout, "read-timeout", "BOOKS_READ_TIMEOUT", 15*time.Second, "time allowed to read a whole request")
+	dur(&cfg.writeTimeout, "write-timeout", "BOOKS_WRITE_TIMEOUT", 30*time.Second, "time allowed to write a response")
+	dur(&cfg.idleTimeout, "idle-timeout", "BOOKS_IDLE_TIMEOUT", 2*time.Minute, "how long to keep idle keep-alive connections")
+	dur(&cfg.shutdownTimeout, "shutdown-timeout", "BOOKS_SHUTDOWN_TIMEOUT", 20*time.Second, "how long to wait for in-flight requests on shutdown")
+	str(&cfg.store, "store", "BOOKS_STORE", "memory", "storage backend: memory or file")
+	str(&cfg.dataFile, "data", "BOOKS_DATA", "books.json", "data file used by the file store")
+	str(&cfg.ids, "ids", "BOOKS_IDS", "uuid", "id generator for new books: uuid or sequence")
+	str(&cfg.jwtSecret, "jwt-secret", "BOOKS_JWT_SECRET", "", "HMAC secret that bearer tokens (HS256 JWTs) are signed with")
+	str(&cfg.apiKeys, "api-keys", "BOOKS_API_KEYS", "", "comma separated name:key:role API keys for service accounts")
+	num(&cfg.readLimit.rate, "read-rate", "BOOKS_READ_RATE", 20, "reads per second allowed per client and route, 0 for no limit")
+	integer(&cfg.readLimit.burst, "read-burst", "BOOKS_READ_BURST", 40, "reads a client may make in a burst")
+	num(&cfg.writeLimit.rate, "write-rate", "BOOKS_WRITE_RATE", 2, "writes per second allowed per client and route, 0 for no limit")
+	integer(&cfg.writeLimit.burst, "write-burst", "BOOKS_WRITE_BURST", 10, "writes a client may make in a burst")
+	var maxBody int
+	integer(&maxBody, "max-body", "BOOKS_MAX_BODY", 1<<20, "largest POST, PUT or PATCH body accepted, in bytes")
+	dur(&cfg.retention, "retention", "BOOKS_RETENTION", 30*24*time.Hour, "how long deleted books can be undeleted before they are purged, 0 to keep them forever")
+	dur(&cfg.purgeInterval, "purge-interval", "BOOKS_PURGE_INTERVAL", time.Hour, "how often to purge deleted books past the retention period")
+	var webhooks string
+	str(&webhooks, "webhooks", "BOOKS_WEBHOOKS", "", "comma separated URLs to POST every book change to")
+	str(&cfg.webhookSecret, "webhook-secret", "BOOKS_WEBHOOK_SECRET", "", "HMAC secret webhook payloads are signed with")
+	dur(&cfg.cacheTTL, "cache-ttl", "BOOKS_CACHE_TTL", 30*time.Second, "how long book reads are answered from the response cache, 0 to not cache them")
+	integer(&cfg.cacheBytes, "cache-bytes", "BOOKS_CACHE_BYTES", 16<<20, "most bytes of responses the response cache holds")
+	dur(&cfg.cacheMaxAge, "cache-max-age", "BOOKS_CACHE_MAX_AGE", 0, "how long clients may reuse book reads without checking back, sent as Cache-Control max-age")
+	dur(&cfg.idempotencyWindow, "idempotency-window", "BOOKS_IDEMPOTENCY_WINDOW", 24*time.Hour, "how long a POST with an Idempotency-Key is answered with its first response, 0 to ignore the header")
+	var origins string
+	str(&origins, "cors-origins", "BOOKS_CORS_ORIGINS", "", "comma separated origins allowed to call the API from a browser, or *")
+
+	if len(envErrs) > 0 {
+		return cfg, errors.New("bad environment: " + strings.Join(envErrs, "; "))
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if (cfg.readLimit.rate > 0 && cfg.readLimit.burst < 1) || (cfg.writeLimit.rate > 0 && cfg.writeLimit.burst < 1) {
+		return cfg, errors.New("a rate limit needs a burst of at least 1")
+	}
+	if cfg.cacheTTL > 0 && cfg.cacheBytes < 1 {
+		return cfg, errors.New("the response cache needs room for at least 1 byte")
+	}
+	if cfg.retention > 0 && cfg.purgeInterval <= 0 {
+		return cfg, errors.New("the purge interval must be positive")
+	}
+	cfg.maxBody = int64(maxBody)
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			cfg.corsOrigins = append(cfg.corsOrigins, o)
+		}
+	}
+	for _, w := range strings.Split(webhooks, ",") {
+		if w = strings.TrimSpace(w); w == "" {
+			continue
+		}
+		if u, err := url.Parse(w); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("webhook %q is not an http or https URL", w)
+		}
+		cfg.webhooks = append(cfg.webhooks, w)
+	}
+	if len(cfg.webhooks) > 0 && cfg.webhookSecret == "" {
+		return cfg, errors.New("webhooks need a webhook secret to sign their payloads")
+	}
+	return cfg, nil
+}
+
+// shutdownKey is the request context key for a channel that is closed
+// when the server starts shutting down
+type shutdownKey struct{}
+
+// connKey is the context key for the connection a request came in on
+type connKey struct{}
+
+// extendWriteDeadline gives the rest of r's response d more to be written,
+// for responses that are streamed for longer than the server's write
+// timeout allows. Requests that don't come through serve, or come over
+// HTTP/2, where the connection is shared, keep the deadline they have.
+func extendWriteDeadline(r *http.Request, d time.Duration) {
+	if c, ok := r.Context().Value(connKey{}).(net.Conn); ok && r.ProtoMajor == 1 {
+		c.SetWriteDeadline(time.Now().Add(d))
+	}
+}
+
+// shutdownOf is closed once the server r came in on starts shutting down.
+// Requests that don't come through serve never see it closed.
+func shutdownOf(r *http.Request) <-chan struct{} {
+	ch, _ := r.Context().Value(shutdownKey{}).(chan struct{})
+	return ch
+}
+
+// newServer sets up an http.Server with the configured timeouts, so a slow
+// client can't hold a connection open forever
+func newServer(cfg config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.readHeaderTimeout,
+		ReadTimeout:       cfg.readTimeout,
+		WriteTimeout:      cfg.writeTimeout,
+		IdleTimeout:       cfg.idleTimeout,
+	}
+}
+
+// serve runs srv on ln until ctx is cancelled, then stops accepting
+// connections and gives in-flight requests up to drain to finish. Event
+// streams never finish by themselves, so they are told to end as the
+// shutdown starts (see shutdownOf); requests still going after drain are
+// cut off.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, drain time.Duration) error {
+	shutdown := make(chan struct{})
+	srv.BaseContext = func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), shutdownKey{}, shutdown)
+	}
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, connKey{}, c)
+	}
+	srv.RegisterOnShutdown(func() { close(shutdown) })
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down, waiting up to %s for requests to finish", drain)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("requests still running after %s, closing their connections", drain)
+		srv.Close()
+	} else if err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	env := map[string]string{
+		"BOOKS_ADDR":         ":9000",
+		"BOOKS_READ_TIMEOUT": "3s",
+		"BOOKS_STORE":        "file",
+		"BOOKS_CORS_ORIGINS": "https://a.example, https://b.example",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	cfg, err := loadConfig(nil, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.addr != ":9000" || cfg.readTimeout != 3*time.Second || cfg.store != "file" {
+		t.Errorf("config from env = %+v, want addr :9000, read timeout 3s and the file store", cfg)
+	}
+	if len(cfg.corsOrigins) != 2 || cfg.corsOrigins[1] != "https://b.example" {
+		t.Errorf("CORS origins = %q, want both from BOOKS_CORS_ORIGINS", cfg.corsOrigins)
+	}
+	if cfg.writeTimeout != 30*time.Second || cfg.dataFile != "books.json" || cfg.ids != "uuid" {
+		t.Errorf("config defaults = %+v", cfg)
+	}
+
+	cfg, err = loadConfig([]string{"-addr", "127.0.0.1:8080", "-read-timeout", "1m", "-data", "/tmp/b.json"}, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.addr != "127.0.0.1:8080" || cfg.readTimeout != time.Minute || cfg.dataFile != "/tmp/b.json" {
+		t.Errorf("flags should win over env, got %+v", cfg)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	if _, err := loadConfig(nil, func(k string) string {
+		if k == "BOOKS_IDLE_TIMEOUT" {
+			return "forever"
+		}
+		return ""
+	}); err == nil {
+		t.Error("BOOKS_IDLE_TIMEOUT=forever accepted, want error")
+	}
+	if _, err := loadConfig([]string{"-write-timeout", "soon"}, noEnv); err == nil {
+		t.Error("-write-timeout soon accepted, want error")
+	}
+	if _, err := loadConfig([]string{"extra"}, noEnv); err == nil {
+		t.Error("stray argument accepted, want error")
+	}
+	if _, err := loadConfig([]string{"-webhooks", "ftp://example.com/hook", "-webhook-secret", "x"}, noEnv); err == nil {
+		t.Error("ftp webhook accepted, want error")
+	}
+	if _, err := loadConfig([]string{"-webhooks", "https://example.com/hook"}, noEnv); err == nil {
+		t.Error("webhooks without a secret accepted, want error")
+	}
+	if _, err := loadConfig([]string{"-purge-interval", "0"}, noEnv); err == nil {
+		t.Error("-purge-interval 0 accepted with a retention period, want error")
+	}
+	if _, err := loadConfig([]string{"-retention", "0", "-purge-interval", "0"}, noEnv); err != nil {
+		t.Errorf("-retention 0 (never purge) with no purge interval: %v", err)
+	}
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, newServer(config{}, handler), ln, 5*time.Second)
+	}()
+
+	got := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		got <- string(body)
+	}()
+
+	<-started
+	cancel() // like SIGTERM arriving mid-request
+	if body := <-got; body != "done" {
+		t.Errorf("in-flight request got %q, want it to finish with %q", body, "done")
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve() = %v, want nil after a clean shutdown", err)
+	}
+	if _, err := http.Get("http://" + ln.Addr().String()); err == nil {
+		t.Error("server still accepting connections after shutdown")
+	}
+}
+
+func TestServeEndsEventStreams(t *testing.T) {
+	useStore(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, newServer(config{}, newRouter()), ln, 5*time.Second)
+	}()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/api/books/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /api/books/events = %d", resp.StatusCode)
+	}
+
+	start := time.Now()
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("serve() with an open event stream = %v, want nil", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("shutdown took %s, want the stream to end straight away", took)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Errorf("event stream ended with %v, want a clean end", err)
+	}
+}
+
+func TestServeCutsOffStuckRequests(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, newServer(config{}, handler), ln, 100*time.Millisecond)
+	}()
+	go http.Get("http://" + ln.Addr().String())
+
+	<-started
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("serve() = %v, want nil once the drain period is up", err)
+	}
+}
+
+func TestExtendWriteDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a response that takes several write timeouts to send
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			extendWriteDeadline(r, 100*time.Millisecond)
+			fmt.Fprintf(w, "part %d\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, newServer(config{writeTimeout: 100 * time.Millisecond}, handler), ln, time.Second)
+	}()
+	defer func() {
+		cancel()
+		<-served
+	}()
+
+	resp, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || !strings.HasSuffix(string(body), "part 4\n") {
+		t.Errorf("body = %q, %v, want all five parts", body, err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// problem is the error body every handler sends, following RFC 7807
+// (application/problem+json)
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	// Errors lists the offending fields of a 422 response
+	Errors ValidationErrors `json:"errors,omitempty"`
+}
+
+// writeProblem sends a problem+json response for status. Type is left as
+// "about:blank", so Title is just the standard status text.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	sendProblem(w, problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+}
+
+// writeInvalid sends a 422 listing every field of what (a book, an author)
+// that failed validation
+func writeInvalid(w http.ResponseWriter, r *http.Request, what string, errs ValidationErrors) {
+	sendProblem(w, problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(http.StatusUnprocessableEntity),
+		Status:   http.StatusUnprocessableEntity,
+		Detail:   "the " + what + " failed validation",
+		Instance: r.URL.Path,
+		Errors:   errs,
+	})
+}
+
+// badBody answers a request whose body couldn't be decoded as what
+func badBody(w http.ResponseWriter, r *http.Request, what string, err error) {
+	if errors.Is(err, errBodyTooLarge) {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, "request body is too large")
+		return
+	}
+	writeProblem(w, r, http.StatusBadRequest, "request body is not "+what+": "+err.Error())
+}
+
+func sendProblem(w http.ResponseWriter, p problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeJSON sends v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// notFound and methodNotAllowed replace mux's plain-text defaults so that
+// unknown routes use the same error format as the handlers
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusNotFound, "no such endpoint")
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusMethodNotAllowed, r.Method+" is not supported on this endpoint")
+}
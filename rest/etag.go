@@ -0,0 +1,115 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etag is the strong entity tag of a book: its version in quotes. It tags
+// the book as v1 JSON shows it; other representations of the book depend on
+// more than its version, and get a variantETag.
+func etag(book Book) string {
+	return `"` + strconv.Itoa(book.Version) + `"`
+}
+
+// variantETag tags a representation of a book at version that also depends
+// on parts: the version, then a digest of the parts. Every tag of a book
+// starts with its version, which is what If-Match checks.
+func variantETag(version int, parts ...[]byte) string {
+	h := fnv.New64a()
+	for _, p := range parts {
+		h.Write(p)
+		h.Write([]byte{0})
+	}
+	return `"` + strconv.Itoa(version) + "-" + strconv.FormatUint(h.Sum64(), 36) + `"`
+}
+
+// presentedETag tags a book as presentBook shows it. With ?expand=author
+// the author is part of the answer, and renaming them changes it without
+// changing the book's version.
+func presentedETag(presented Book) string {
+	a := presented.Author
+	if a == nil {
+		return etag(presented)
+	}
+	return variantETag(presented.Version, []byte(a.ID), []byte(a.Firstname), []byte(a.Lastname))
+}
+
+// tagVersion is the book version a tag was made from
+func tagVersion(tag string) (int, bool) {
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+	tag = tag[1 : len(tag)-1]
+	if i := strings.IndexByte(tag, '-'); i >= 0 {
+		tag = tag[:i]
+	}
+	v, err := strconv.Atoi(tag)
+	return v, err == nil
+}
+
+// strongMatch reports whether an If-Match header value (a comma separated list
+// of tags, or "*") includes a current tag of the book: one made from its
+// current version, whichever representation it came with. If-Match compares
+// strongly, as RFC 9110 requires, so a weak tag never matches.
+func strongMatch(header string, book Book) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if v, ok := tagVersion(tag); ok && v == book.Version {
+			return true
+		}
+	}
+	return false
+}
+
+// weakMatch reports whether an If-None-Match header value includes tag.
+// If-None-Match compares weakly: tags match by their opaque part, W/ or not.
+func weakMatch(header, tag string) bool {
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch evaluates If-Match against the stored book. It returns the
+// version the change must apply to (0 if the client sent no If-Match), or
+// false after writing a 404 or 412 response.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, id string) (int, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, true
+	}
+	current, err := store.Get(id)
+	if err != nil {
+		storeError(w, r, err)
+		return 0, false
+	}
+	if !strongMatch(header, current) {
+		preconditionFailed(w, r, current)
+		return 0, false
+	}
+	return current.Version, true
+}
+
+// preconditionFailed sends a 412 along with the tag the book is really at,
+// so the client knows what to re-fetch
+func preconditionFailed(w http.ResponseWriter, r *http.Request, current Book) {
+	w.Header().Set("ETag", etag(current))
+	writeProblem(w, r, http.StatusPreconditionFailed, "the book has been changed since you fetched it")
+}
+
+// writeBook answers with book as presentBook shows it, and that answer's tag
+func writeBook(w http.ResponseWriter, r *http.Request, status int, book Book) {
+	presented := presentBook(r, book)
+	w.Header().Set("ETag", presentedETag(presented))
+	writeJSON(w, status, presented)
+}
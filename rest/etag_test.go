@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	body := `{"title":"Renamed","author":{"lastname":"Smith"}}`
+	tests := []struct {
+		name       string
+		method     string
+		header     string
+		value      string
+		body       string
+		wantStatus int
+		wantETag   string
+	}{
+		{"get", "GET", "", "", "", http.StatusOK, `"2"`},
+		{"get, not modified", "GET", "If-None-Match", `"2"`, "", http.StatusNotModified, `"2"`},
+		{"get, weak tag not modified", "GET", "If-None-Match", `W/"2"`, "", http.StatusNotModified, `"2"`},
+		{"get, stale copy", "GET", "If-None-Match", `"1"`, "", http.StatusOK, `"2"`},
+		{"put without If-Match", "PUT", "", "", body, http.StatusOK, `"3"`},
+		{"put, current tag", "PUT", "If-Match", `"2"`, body, http.StatusOK, `"3"`},
+		{"put, one of several tags", "PUT", "If-Match", `"1", "2"`, body, http.StatusOK, `"3"`},
+		{"put, any tag", "PUT", "If-Match", `*`, body, http.StatusOK, `"3"`},
+		{"put, stale tag", "PUT", "If-Match", `"1"`, body, http.StatusPreconditionFailed, `"2"`},
+		{"put, weak tag", "PUT", "If-Match", `W/"2"`, body, http.StatusPreconditionFailed, `"2"`},
+		{"patch, current tag", "PATCH", "If-Match", `"2"`, `{"title":"Renamed"}`, http.StatusOK, `"3"`},
+		{"patch, stale tag", "PATCH", "If-Match", `"1"`, `{"title":"Renamed"}`, http.StatusPreconditionFailed, `"2"`},
+		{"patch, weak tag", "PATCH", "If-Match", `W/"2"`, `{"title":"Renamed"}`, http.StatusPreconditionFailed, `"2"`},
+		{"delete, current tag", "DELETE", "If-Match", `"2"`, "", http.StatusNoContent, ""},
+		{"delete, stale tag", "DELETE", "If-Match", `"1"`, "", http.StatusPreconditionFailed, `"2"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Lastname: "Smith"}})
+			book, _ := store.Get("1")
+			store.Update("1", book) // version 2
+
+			req := editorRequest(tc.method, "/api/books/1", tc.body)
+			req.Header.Set("Content-Type", "application/json")
+			if tc.header != "" {
+				req.Header.Set(tc.header, tc.value)
+			}
+			rec := httptest.NewRecorder()
+			newRouter().ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("%s with %s %s = %d, want %d (body %s)", tc.method, tc.header, tc.value, rec.Code, tc.wantStatus, rec.Body)
+			}
+			if got := rec.Header().Get("ETag"); got != tc.wantETag {
+				t.Errorf("ETag = %s, want %s", got, tc.wantETag)
+			}
+			if tc.wantStatus == http.StatusNotModified && rec.Body.Len() != 0 {
+				t.Errorf("304 response has a body: %s", rec.Body)
+			}
+			if tc.wantStatus == http.StatusPreconditionFailed {
+				if b, _ := store.Get("1"); b.Version != 2 || b.Title != "Sample book" {
+					t.Errorf("book changed despite the failed precondition: %+v", b)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType says what happened to a book
+type EventType string
+
+const (
+	BookCreated   EventType = "book.created"
+	BookUpdated   EventType = "book.updated"
+	BookDeleted   EventType = "book.deleted"
+	BookUndeleted EventType = "book.undeleted"
+)
+
+// Event is published on the bus after every successful change to a book
+type Event struct {
+	ID   string    `json:"id"` // unique; "<epoch>-<sequence>", see eventBus
+	Type EventType `json:"type"`
+	At   time.Time `json:"at"`
+	By   string    `json:"by,omitempty"`
+	Book Book      `json:"book"` // as it is now; as it was for book.deleted
+}
+
+// recentEvents is how many events the bus keeps for subscribers that
+// reconnect and ask for what they missed
+const recentEvents = 256
+
+// eventBus fans events out to subscribers. Every event gets the next
+// sequence number, prefixed with an epoch picked at startup so IDs from
+// before a restart aren't mistaken for new ones.
+type eventBus struct {
+	mu     sync.Mutex
+	epoch  string
+	seq    uint64
+	recent []Event
+	subs   map[chan Event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{epoch: strconv.FormatInt(time.Now().UnixNano(), 36), subs: map[chan Event]struct{}{}}
+}
+
+// events carries every change made through the store to the webhooks and
+// the event stream
+var events = newEventBus()
+
+// publish stamps e with an ID and hands it to every subscriber. It never
+// blocks: a subscriber whose buffer is full is dropped, its channel
+// closed, and has to subscribe again and catch up with since.
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e.ID = b.eventID(b.seq)
+	b.recent = append(b.recent, e)
+	if len(b.recent) > recentEvents {
+		b.recent = b.recent[len(b.recent)-recentEvents:]
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel of events published from now on, and a
+// function to stop them
+func (b *eventBus) subscribe(buffer int) (<-chan Event, func()) {
+	ch, cancel, _ := b.subscribeAt(buffer)
+	return ch, cancel
+}
+
+// subscribeAt is subscribe that also returns the sequence number of the
+// last event published before the subscription started
+func (b *eventBus) subscribeAt(buffer int) (<-chan Event, func(), uint64) {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	seq := b.seq
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}, seq
+}
+
+// since returns the recent events published after the one with the given
+// ID, as far back as the bus remembers. An ID from another epoch gets
+// nothing, as the events it refers to are gone.
+func (b *eventBus) since(id string) []Event {
+	seq, ok := b.sequence(id)
+	if !ok {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var missed []Event
+	for _, e := range b.recent {
+		if n, _ := b.sequence(e.ID); n > seq {
+			missed = append(missed, e)
+		}
+	}
+	return missed
+}
+
+// eventID is the ID of the event with sequence number seq in this epoch
+func (b *eventBus) eventID(seq uint64) string {
+	return b.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// sequence is the sequence number in an event ID of this epoch
+func (b *eventBus) sequence(id string) (uint64, bool) {
+	i := strings.LastIndexByte(id, '-')
+	if i < 0 || id[:i] != b.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(id[i+1:], 10, 64)
+	return n, err == nil
+}
+
+// publishingStore is a BookStore that publishes an event on the bus for
+// every change it makes to a book. Changes go through one at a time, each
+// published before the next starts, so events are in the order the
+// changes were made: otherwise two updates racing could publish version 3
+// before version 2.
+type publishingStore struct {
+	BookStore
+	mu *sync.Mutex
+}
+
+// publishChanges wraps s so changes made through it are published
+func publishChanges(s BookStore) BookStore {
+	return publishingStore{s, &sync.Mutex{}}
+}
+
+func (s publishingStore) Create(book Book) (Book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	created, err := s.BookStore.Create(book)
+	if err == nil {
+		events.publish(Event{Type: BookCreated, At: created.UpdatedAt, By: created.UpdatedBy, Book: created})
+	}
+	return created, err
+}
+
+// CreateMany publishes the books it creates once they are all in
+func (s publishingStore) CreateMany(authors []Author, books []Book) ([]Book, []error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	created, errs, err := s.BookStore.CreateMany(authors, books)
+	if err == nil {
+		for i, b := range created {
+			if errs[i] == nil {
+				events.publish(Event{Type: BookCreated, At: b.UpdatedAt, By: b.UpdatedBy, Book: b})
+			}
+		}
+	}
+	return created, errs, err
+}
+
+func (s publishingStore) Update(id string, book Book) (Book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	updated, err := s.BookStore.Update(id, book)
+	if err == nil {
+		events.publish(Event{Type: BookUpdated, At: updated.UpdatedAt, By: updated.UpdatedBy, Book: updated})
+	}
+	return updated, err
+}
+
+// Delete pins the version it deletes so the event carries the book exactly
+// as it was, trying again if a change made around this wrapper gets in
+// between
+func (s publishingStore) Delete(id string, version int, by string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		book, err := s.BookStore.Get(id)
+		if err != nil {
+			return err
+		}
+		if version != 0 && version != book.Version {
+			return ErrVersionConflict
+		}
+		err = s.BookStore.Delete(id, book.Version, by)
+		if errors.Is(err, ErrVersionConflict) && version == 0 && attempt < 5 {
+			continue
+		}
+		if err == nil {
+			events.publish(Event{Type: BookDeleted, At: s.deletedAt(id), By: by, Book: book})
+		}
+		return err
+	}
+}
+
+// deletedAt is when the store recorded deleting the book id, which has
+// just happened, or now if its history doesn't say
+func (s publishingStore) deletedAt(id string) time.Time {
+	changes, err := s.BookStore.History(id)
+	if err == nil && len(changes) > 0 {
+		if last := changes[len(changes)-1]; last.Action == "deleted" {
+			return last.At
+		}
+	}
+	return time.Now().UTC()
+}
+
+func (s publishingStore) Undelete(id, by string) (Book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	restored, err := s.BookStore.Undelete(id, by)
+	if err == nil {
+		events.publish(Event{Type: BookUndeleted, At: restored.UpdatedAt, By: by, Book: restored})
+	}
+	return restored, err
+}
+
+// Ping passes readiness checks through to the wrapped store
+func (s publishingStore) Ping() error {
+	if p, ok := s.BookStore.(pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+// streamFor is how long one event stream stays open. The server's write
+// timeout would cut it off anyway, so it ends cleanly a little before and
+// the browser reconnects, picking up where it left off with Last-Event-ID.
+// 0 means no limit.
+var streamFor time.Duration
+
+// heartbeat is how often an idle event stream gets a comment, so proxies
+// don't take it for dead
+var heartbeat = 15 * time.Second
+
+// getBookEvents streams book changes as Server-Sent Events
+func getBookEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProblem(w, r, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	// subscribe before catching up so nothing falls in between
+	ch, cancel := events.subscribe(64)
+	defer cancel()
+	missed := events.since(r.Header.Get("Last-Event-ID"))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx would hold the events back otherwise
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: 1000\n\n")
+
+	var last uint64
+	send := func(e Event) bool {
+		seq, _ := events.sequence(e.ID)
+		if seq <= last {
+			return true // already sent while catching up
+		}
+		last = seq
+		data, _ := json.Marshal(e)
+		_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		return err == nil
+	}
+	for _, e := range missed {
+		if !send(e) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	var end <-chan time.Time
+	if streamFor > 0 {
+		timer := time.NewTimer(streamFor)
+		defer timer.Stop()
+		end = timer.C
+	}
+	tick := time.NewTicker(heartbeat)
+	defer tick.Stop()
+	shutdown := shutdownOf(r)
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return // too slow to keep up; the client reconnects and catches up
+			}
+			if !send(e) {
+				return
+			}
+		case <-tick.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-end:
+			return
+		case <-shutdown:
+			return // the client reconnects to another instance, or to us once we're back
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := newEventBus()
+	ch, cancel := bus.subscribe(10)
+	defer cancel()
+
+	bus.publish(Event{Type: BookCreated, Book: Book{ID: "1"}})
+	bus.publish(Event{Type: BookUpdated, Book: Book{ID: "1"}})
+	first, second := <-ch, <-ch
+	if first.Type != BookCreated || second.Type != BookUpdated || first.ID == second.ID {
+		t.Fatalf("got %+v then %+v, want created then updated with different IDs", first, second)
+	}
+	if missed := bus.since(first.ID); len(missed) != 1 || missed[0].ID != second.ID {
+		t.Errorf("since(first) = %+v, want just the second event", missed)
+	}
+	if missed := bus.since("someotherepoch-1"); len(missed) != 0 {
+		t.Errorf("since an ID from another epoch = %+v, want nothing", missed)
+	}
+
+	slow, cancelSlow := bus.subscribe(1)
+	defer cancelSlow()
+	bus.publish(Event{Type: BookDeleted})
+	bus.publish(Event{Type: BookDeleted})
+	<-slow
+	if _, ok := <-slow; ok {
+		t.Error("a subscriber that fell behind was kept, want its channel closed")
+	}
+}
+
+func TestChangesArePublished(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Lastname: "Smith"}})
+	store = publishChanges(store)
+	router := newRouter()
+	ch, cancel := events.subscribe(10)
+	defer cancel()
+
+	rec := do(t, router, "POST", "/api/books", `{"title":"New","author":{"lastname":"Smith"}}`)
+	var created Book
+	json.NewDecoder(rec.Body).Decode(&created)
+	do(t, router, "PUT", "/api/books/1", `{"title":"Renamed","author":{"lastname":"Smith"}}`)
+	do(t, router, "DELETE", "/api/books/1", "")
+	do(t, router, "POST", "/api/books/1:undelete", "")
+	do(t, router, "DELETE", "/api/books/404", "") // fails, so nothing to publish
+
+	want := []struct {
+		typ     EventType
+		id      string
+		version int
+	}{
+		{BookCreated, created.ID, 1},
+		{BookUpdated, "1", 2},
+		{BookDeleted, "1", 2},
+		{BookUndeleted, "1", 3},
+	}
+	for _, w := range want {
+		select {
+		case e := <-ch:
+			if e.Type != w.typ || e.Book.ID != w.id || e.Book.Version != w.version || e.By != "apikey:tests" {
+				t.Errorf("event = %+v, want %s of book %s at version %d by apikey:tests", e, w.typ, w.id, w.version)
+			}
+			// the event happened when the history says it did
+			history, _ := store.History(e.Book.ID)
+			found := false
+			for _, c := range history {
+				found = found || (c.Action == strings.TrimPrefix(string(e.Type), "book.") && c.At.Equal(e.At))
+			}
+			if !found {
+				t.Errorf("%s event at %s has no change at the same time in the history %+v", e.Type, e.At, history)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event", w.typ)
+		}
+	}
+	select {
+	case e := <-ch:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestConcurrentChangesArePublishedInOrder(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Lastname: "Smith"}})
+	store = publishChanges(dawdlingStore{store})
+	ch, cancel := events.subscribe(100)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			book := storedBook(t, "1")
+			book.Version = 0 // no version check, so every update goes through
+			if _, err := store.Update("1", book); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	last := 1
+	for i := 0; i < 50; i++ {
+		e := <-ch
+		if e.Book.Version != last+1 {
+			t.Fatalf("event %d is for version %d, want %d", i+1, e.Book.Version, last+1)
+		}
+		last = e.Book.Version
+	}
+}
+
+// dawdlingStore takes a moment to return from an update it has made,
+// giving other updates the chance to overtake it
+type dawdlingStore struct {
+	BookStore
+}
+
+func (s dawdlingStore) Update(id string, book Book) (Book, error) {
+	updated, err := s.BookStore.Update(id, book)
+	time.Sleep(time.Duration(updated.Version%3) * time.Millisecond)
+	return updated, err
+}
+
+func TestPublishingStorePassesPingThrough(t *testing.T) {
+	fs, err := newFileStore(t.TempDir() + "/missing/books.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publishChanges(fs).(pinger).Ping(); err == nil {
+		t.Error("Ping through the publishing store = nil, want the file store's error")
+	}
+}
+
+// sseEvent is one event read off a text/event-stream
+type sseEvent struct {
+	id, event, data string
+}
+
+func readSSE(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the event stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && e.data != "":
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.id = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			e.event = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			e.data = line[6:]
+		}
+	}
+}
+
+func TestBookEventStream(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Lastname: "Smith"}})
+	store = publishChanges(store)
+	srv := httptest.NewServer(withMiddleware(newRouter(), config{}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/books/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET /api/books/events = %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	stream := bufio.NewReader(resp.Body)
+
+	do(t, newRouter(), "PUT", "/api/books/1", `{"title":"Renamed","author":{"lastname":"Smith"}}`)
+	got := readSSE(t, stream)
+	var e Event
+	if err := json.Unmarshal([]byte(got.data), &e); err != nil {
+		t.Fatal(err)
+	}
+	if got.event != "book.updated" || got.id != e.ID || e.Book.Title != "Renamed" {
+		t.Fatalf("streamed %+v, want book.updated with the new title", got)
+	}
+
+	// a client that reconnects gets what it missed since its last event
+	do(t, newRouter(), "DELETE", "/api/books/1", "")
+	req, _ := http.NewRequest("GET", srv.URL+"/api/books/events", nil)
+	req.Header.Set("Last-Event-ID", got.id)
+	again, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Body.Close()
+	if missed := readSSE(t, bufio.NewReader(again.Body)); missed.event != "book.deleted" {
+		t.Errorf("after reconnecting got %+v, want the missed book.deleted", missed)
+	}
+}
+
+func TestBookEventStreamEndsBeforeWriteTimeout(t *testing.T) {
+	useStore(t)
+	streamFor = 50 * time.Millisecond
+	defer func() { streamFor = 0 }()
+
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	start := time.Now()
+	resp, err := http.Get(srv.URL + "/api/books/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := new(strings.Builder)
+	if _, err := bufio.NewReader(resp.Body).WriteTo(body); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stream stayed open for %s, want it closed after 50ms", elapsed)
+	}
+	if !strings.HasPrefix(body.String(), "retry: ") {
+		t.Errorf("stream = %q, want a retry hint for the reconnect", body)
+	}
+}
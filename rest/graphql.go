@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// /graphql serves the same books and authors as the REST routes, through
+// the same store, validation and author resolution. Queries are public and
+// count against the read limit; mutations need the editor role and count
+// against the write limit, like the REST writes.
+//
+//	type Query {
+//	  book(id: ID!): Book
+//	  books(search: String, author: String, title: String, isbn: String,
+//	        sort: String, limit: Int, offset: Int): [Book!]!
+//	  author(id: ID!): Author
+//	  authors: [Author!]!
+//	}
+//	type Mutation {
+//	  createBook(input: BookInput!): Book!
+//	  updateBook(id: ID!, input: BookInput!, version: Int): Book!
+//	  deleteBook(id: ID!, version: Int): Boolean!
+//	}
+//
+// Failures come back in errors[] with extensions.code set to BAD_USER_INPUT
+// (with extensions.fields for invalid input), NOT_FOUND, GONE, CONFLICT
+// or INTERNAL.
+
+// maxGraphQLDepth caps how deeply selections nest, so a client can't ask
+// for book { author { books { author { books ... } } } } without end
+const maxGraphQLDepth = 8
+
+// graphqlRequest is a POST /graphql body, or the query string of a GET
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+type graphqlRequestKey struct{}
+
+// routeGraphQL reads a GraphQL request and hands it to query or mutation
+// depending on which kind of operation it runs
+func routeGraphQL(query, mutation http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := readGraphQLRequest(r)
+		if err != nil {
+			badBody(w, r, "a GraphQL request", err)
+			return
+		}
+		if req.Query == "" {
+			writeProblem(w, r, http.StatusBadRequest, "the GraphQL request has no query")
+			return
+		}
+		kind := "query"
+		// a query that doesn't parse is left for graphql.Do to report
+		if doc, err := parser.Parse(parser.ParseParams{Source: req.Query}); err == nil {
+			op, fragments := findOperation(doc, req.OperationName)
+			if op != nil {
+				kind = op.Operation
+				if selectionDepth(op.SelectionSet, fragments, 0) > maxGraphQLDepth {
+					writeGraphQLError(w, &graphqlError{code: "BAD_USER_INPUT", message: "selections nest more than " + strconv.Itoa(maxGraphQLDepth) + " deep"})
+					return
+				}
+			}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), graphqlRequestKey{}, req))
+		switch {
+		case kind != "mutation":
+			query(w, r)
+		case r.Method == http.MethodGet:
+			w.Header().Set("Allow", "POST")
+			writeProblem(w, r, http.StatusMethodNotAllowed, "mutations must be sent with POST")
+		default:
+			mutation(w, r)
+		}
+	}
+}
+
+func readGraphQLRequest(r *http.Request) (graphqlRequest, error) {
+	var req graphqlRequest
+	if r.Method == http.MethodGet {
+		values := r.URL.Query()
+		req.Query, req.OperationName = values.Get("query"), values.Get("operationName")
+		if v := values.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return req, err
+			}
+		}
+		return req, nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/graphql" {
+		query, err := io.ReadAll(r.Body)
+		req.Query = string(query)
+		return req, err
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	return req, err
+}
+
+// findOperation finds the operation a request runs, and the fragments it can use
+func findOperation(doc *ast.Document, name string) (*ast.OperationDefinition, map[string]*ast.FragmentDefinition) {
+	var op *ast.OperationDefinition
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, def := range doc.Definitions {
+		switch def := def.(type) {
+		case *ast.OperationDefinition:
+			if name == "" || (def.Name != nil && def.Name.Value == name) {
+				op = def
+			}
+		case *ast.FragmentDefinition:
+			fragments[def.Name.Value] = def
+		}
+	}
+	return op, fragments
+}
+
+// selectionDepth is how deeply set nests, following fragments. It stops
+// counting past the limit, which also ends fragments that spread themselves.
+func selectionDepth(set *ast.SelectionSet, fragments map[string]*ast.FragmentDefinition, depth int) int {
+	if set == nil || depth > maxGraphQLDepth {
+		return depth
+	}
+	deepest := depth
+	for _, sel := range set.Selections {
+		var d int
+		switch sel := sel.(type) {
+		case *ast.Field:
+			d = selectionDepth(sel.SelectionSet, fragments, depth+1)
+		case *ast.InlineFragment:
+			d = selectionDepth(sel.SelectionSet, fragments, depth)
+		case *ast.FragmentSpread:
+			if f, ok := fragments[sel.Name.Value]; ok {
+				d = selectionDepth(f.SelectionSet, fragments, depth)
+			}
+		}
+		if d > deepest {
+			deepest = d
+		}
+	}
+	return deepest
+}
+
+// serveGraphQL runs a request read by routeGraphQL
+func serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	req := r.Context().Value(graphqlRequestKey{}).(graphqlRequest)
+	result := graphql.Do(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        r.Context(),
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+func writeGraphQLError(w http.ResponseWriter, err *graphqlError) {
+	writeJSON(w, http.StatusBadRequest, obj{"errors": []obj{{"message": err.message, "extensions": err.Extensions()}}})
+}
+
+// graphqlError is an error with a code for extensions.code, and the field
+// errors for invalid input
+type graphqlError struct {
+	code    string
+	message string
+	fields  ValidationErrors
+}
+
+func (e *graphqlError) Error() string {
+	return e.message
+}
+
+func (e *graphqlError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": e.code}
+	if len(e.fields) > 0 {
+		ext["fields"] = e.fields
+	}
+	return ext
+}
+
+// graphqlStoreError is storeError for resolvers
+func graphqlStoreError(err error, id string) error {
+	switch {
+	case errors.Is(err, ErrBookDeleted):
+		return &graphqlError{code: "GONE", message: "book " + id + " has been deleted"}
+	case errors.Is(err, ErrBookNotFound):
+		return &graphqlError{code: "NOT_FOUND", message: "no book with id " + id}
+	case errors.Is(err, ErrAuthorNotFound):
+		return &graphqlError{code: "BAD_USER_INPUT", message: "invalid input", fields: ValidationErrors{{Field: "authorId", Message: "no author has this id"}}}
+	case errors.Is(err, ErrVersionConflict):
+		return &graphqlError{code: "CONFLICT", message: "the book has been changed since you fetched it"}
+	}
+	log.Printf("graphql: %v", err)
+	return &graphqlError{code: "INTERNAL", message: "the book store failed, please try again later"}
+}
+
+var graphqlSchema = newGraphQLSchema()
+
+func newGraphQLSchema() graphql.Schema {
+	str := func(get func(Book) string) *graphql.Field {
+		return &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(Book)), nil
+		}}
+	}
+	authorType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Author",
+		Fields: graphql.Fields{
+			"id":        {Type: graphql.NewNonNull(graphql.ID)},
+			"firstname": {Type: graphql.String},
+			"lastname":  {Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	bookType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Book",
+		Fields: graphql.Fields{
+			"id":        {Type: graphql.NewNonNull(graphql.ID)},
+			"isbn":      {Type: graphql.String},
+			"title":     {Type: graphql.NewNonNull(graphql.String)},
+			"authorId":  str(func(b Book) string { return b.AuthorID }),
+			"author":    {Type: authorType, Resolve: resolveBookAuthor},
+			"version":   {Type: graphql.NewNonNull(graphql.Int)},
+			"updatedBy": str(func(b Book) string { return b.UpdatedBy }),
+			"updatedAt": {Type: graphql.DateTime, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Book).UpdatedAt, nil
+			}},
+		},
+	})
+	bookList := graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(bookType)))
+	listArgs := graphql.FieldConfigArgument{
+		"search": {Type: graphql.String, Description: "words to look for, as in /api/books/search; best match first"},
+		"author": {Type: graphql.String, Description: "author last name, case-insensitive"},
+		"title":  {Type: graphql.String, Description: "substring of the title, case-insensitive"},
+		"isbn":   {Type: graphql.String, Description: "exact ISBN, hyphens ignored"},
+		"sort":   {Type: graphql.String, Description: "id, title or isbn; prefix with - for descending"},
+		"limit":  {Type: graphql.Int, DefaultValue: defaultPageSize},
+		"offset": {Type: graphql.Int, DefaultValue: 0},
+	}
+	authorType.AddFieldConfig("books", &graphql.Field{
+		Type: bookList,
+		Args: listArgs,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return resolveBooks(p, p.Source.(Author).ID)
+		},
+	})
+
+	authorInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "AuthorInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"firstname": {Type: graphql.String},
+			"lastname":  {Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	bookInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:        "BookInput",
+		Description: "a book names its author with authorId, or gives the author's names to match or create one",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"isbn":     {Type: graphql.String},
+			"title":    {Type: graphql.NewNonNull(graphql.String)},
+			"authorId": {Type: graphql.ID},
+			"author":   {Type: authorInput},
+		},
+	})
+	id := &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)}
+	version := &graphql.ArgumentConfig{Type: graphql.Int, Description: "only change the book if it is still at this version"}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"book": {
+				Type: bookType,
+				Args: graphql.FieldConfigArgument{"id": id},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					book, err := store.Get(p.Args["id"].(string))
+					if errors.Is(err, ErrBookNotFound) {
+						return nil, nil
+					}
+					if err != nil {
+						return nil, graphqlStoreError(err, p.Args["id"].(string))
+					}
+					return book, nil
+				},
+			},
+			"books": {
+				Type: bookList,
+				Args: listArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return resolveBooks(p, "")
+				},
+			},
+			"author": {
+				Type: authorType,
+				Args: graphql.FieldConfigArgument{"id": id},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					author, err := store.GetAuthor(p.Args["id"].(string))
+					if errors.Is(err, ErrAuthorNotFound) {
+						return nil, nil
+					}
+					if err != nil {
+						return nil, graphqlStoreError(err, "")
+					}
+					return author, nil
+				},
+			},
+			"authors": {
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(authorType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					authors, err := store.ListAuthors()
+					if err != nil {
+						return nil, graphqlStoreError(err, "")
+					}
+					return authors, nil
+				},
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createBook": {
+				Type: graphql.NewNonNull(bookType),
+				Args: graphql.FieldConfigArgument{"input": {Type: graphql.NewNonNull(bookInput)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					book, err := bookFromInput(p)
+					if err != nil {
+						return nil, err
+					}
+					book, err = insertBook(book)
+					if err != nil {
+						return nil, graphqlStoreError(err, "")
+					}
+					return book, nil
+				},
+			},
+			"updateBook": {
+				Type: graphql.NewNonNull(bookType),
+				Args: graphql.FieldConfigArgument{"id": id, "input": {Type: graphql.NewNonNull(bookInput)}, "version": version},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					book, err := bookFromInput(p)
+					if err != nil {
+						return nil, err
+					}
+					book.ID = p.Args["id"].(string)
+					book.Version, _ = p.Args["version"].(int)
+					book, err = store.Update(book.ID, book)
+					if err != nil {
+						return nil, graphqlStoreError(err, book.ID)
+					}
+					return book, nil
+				},
+			},
+			"deleteBook": {
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{"id": id, "version": version},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					bookID := p.Args["id"].(string)
+					v, _ := p.Args["version"].(int)
+					principal, _ := principalFrom(p.Context)
+					if err := store.Delete(bookID, v, principal.Subject); err != nil {
+						return nil, graphqlStoreError(err, bookID)
+					}
+					return true, nil
+				},
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// resolveBooks lists books as GET /api/books and /api/books/search do,
+// only those by authorID if it is set
+func resolveBooks(p graphql.ResolveParams, authorID string) (interface{}, error) {
+	values := url.Values{}
+	for name, v := range p.Args {
+		switch v := v.(type) {
+		case string:
+			values.Set(name, v)
+		case int:
+			values.Set(name, strconv.Itoa(v))
+		}
+	}
+	q, err := parseListQuery(values)
+	if err != nil {
+		return nil, &graphqlError{code: "BAD_USER_INPUT", message: err.Error()}
+	}
+	var books []Book
+	if search := strings.TrimSpace(values.Get("search")); search != "" {
+		books, err = store.Search(search)
+	} else {
+		books, err = store.List()
+	}
+	if err == nil {
+		books, err = withAuthors(books)
+	}
+	if err != nil {
+		return nil, graphqlStoreError(err, "")
+	}
+	if authorID != "" {
+		mine := books[:0]
+		for _, b := range books {
+			if b.AuthorID == authorID {
+				mine = append(mine, b)
+			}
+		}
+		books = mine
+	}
+	page, _ := q.apply(books)
+	return page, nil
+}
+
+// resolveBookAuthor uses the author withAuthors filled in if there is one,
+// and looks it up otherwise
+func resolveBookAuthor(p graphql.ResolveParams) (interface{}, error) {
+	book := p.Source.(Book)
+	if book.Author != nil {
+		return *book.Author, nil
+	}
+	if book.AuthorID == "" {
+		return nil, nil
+	}
+	author, err := store.GetAuthor(book.AuthorID)
+	if errors.Is(err, ErrAuthorNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, graphqlStoreError(err, book.ID)
+	}
+	return author, nil
+}
+
+// bookFromInput is readBook for mutations: it builds a Book from the
+// input argument, validates it and resolves its author
+func bookFromInput(p graphql.ResolveParams) (Book, error) {
+	in := p.Args["input"].(map[string]interface{})
+	str := func(m map[string]interface{}, key string) string {
+		s, _ := m[key].(string)
+		return s
+	}
+	book := Book{Isbn: str(in, "isbn"), Title: str(in, "title"), AuthorID: str(in, "authorId")}
+	if a, ok := in["author"].(map[string]interface{}); ok {
+		book.Author = &Author{Firstname: str(a, "firstname"), Lastname: str(a, "lastname")}
+	}
+	if err := book.Validate(); err != nil {
+		fields := err.(ValidationErrors)
+		for i := range fields {
+			if fields[i].Field == "author_id" {
+				fields[i].Field = "authorId"
+			}
+		}
+		return Book{}, &graphqlError{code: "BAD_USER_INPUT", message: "invalid input: " + fields.Error(), fields: fields}
+	}
+	if err := resolveAuthor(&book); err != nil {
+		return Book{}, graphqlStoreError(err, "")
+	}
+	principal, _ := principalFrom(p.Context)
+	book.UpdatedBy = principal.Subject
+	return book, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type graphqlResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string `json:"message"`
+		Extensions struct {
+			Code   string           `json:"code"`
+			Fields ValidationErrors `json:"fields"`
+		} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// gql POSTs query as an editor and decodes the response
+func gql(t *testing.T, h http.Handler, query string, variables map[string]interface{}) graphqlResponse {
+	t.Helper()
+	body, _ := json.Marshal(graphqlRequest{Query: query, Variables: variables})
+	rec := do(t, h, "POST", "/graphql", string(body))
+	var resp graphqlResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("POST /graphql = %d %v", rec.Code, err)
+	}
+	return resp
+}
+
+func TestGraphQLQueries(t *testing.T) {
+	useStore(t,
+		Book{ID: "1", Isbn: "0306406152", Title: "Go in Action", Author: &Author{Firstname: "Bill", Lastname: "Kennedy"}},
+		Book{ID: "2", Title: "Concurrency in Go", Author: &Author{Firstname: "Katherine", Lastname: "Cox-Buday"}},
+		Book{ID: "3", Title: "Go Web Programming", Author: &Author{Firstname: "Sau Sheong", Lastname: "Chang"}},
+	)
+	router := newRouter()
+
+	resp := gql(t, router, `{ book(id: "1") { title isbn version author { lastname books { id } } } }`, nil)
+	if got := string(resp.Data["book"]); got != `{"author":{"books":[{"id":"1"}],"lastname":"Kennedy"},"isbn":"0306406152","title":"Go in Action","version":1}` {
+		t.Errorf("book = %s", got)
+	}
+
+	resp = gql(t, router, `query($q: String) { books(search: $q, sort: "-title", limit: 1) { id } }`, map[string]interface{}{"q": "go"})
+	if got := string(resp.Data["books"]); got != `[{"id":"3"}]` {
+		t.Errorf("books(search: go, sort: -title, limit: 1) = %s", got)
+	}
+	resp = gql(t, router, `{ books(author: "cox-buday") { title authorId } }`, nil)
+	if !strings.Contains(string(resp.Data["books"]), "Concurrency in Go") || strings.Contains(string(resp.Data["books"]), "Go in Action") {
+		t.Errorf("books(author: cox-buday) = %s", resp.Data["books"])
+	}
+
+	resp = gql(t, router, `{ book(id: "404") { id } }`, nil)
+	if string(resp.Data["book"]) != "null" || len(resp.Errors) != 0 {
+		t.Errorf("unknown book = %s %+v, want null without errors", resp.Data["book"], resp.Errors)
+	}
+	resp = gql(t, router, `{ books(sort: "author") { id } }`, nil)
+	if len(resp.Errors) != 1 || resp.Errors[0].Extensions.Code != "BAD_USER_INPUT" {
+		t.Errorf("bad sort: errors = %+v, want BAD_USER_INPUT", resp.Errors)
+	}
+
+	// queries run over GET too, and need no credentials
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/graphql?query="+url.QueryEscape(`{ authors { lastname } }`), nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Cox-Buday") {
+		t.Errorf("GET authors = %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestGraphQLMutations(t *testing.T) {
+	useStore(t)
+	router := newRouter()
+
+	const create = `mutation($in: BookInput!) { createBook(input: $in) { id title version updatedBy author { id lastname } } }`
+	resp := gql(t, router, create, map[string]interface{}{"in": map[string]interface{}{
+		"isbn": "978-0-306-40615-7", "title": "The Go Programming Language", "author": map[string]interface{}{"firstname": "Alan", "lastname": "Donovan"},
+	}})
+	var created struct {
+		ID, Title, UpdatedBy string
+		Version              int
+		Author               Author
+	}
+	if err := json.Unmarshal(resp.Data["createBook"], &created); err != nil || created.ID == "" || created.Version != 1 || created.UpdatedBy != "apikey:tests" || created.Author.Lastname != "Donovan" {
+		t.Fatalf("createBook = %s %+v", resp.Data["createBook"], resp.Errors)
+	}
+	if stored := storedBook(t, created.ID); stored.Isbn != "978-0-306-40615-7" || stored.AuthorID != created.Author.ID {
+		t.Errorf("stored = %+v, want the ISBN as given and the new author", stored)
+	}
+
+	resp = gql(t, router, create, map[string]interface{}{"in": map[string]interface{}{"title": " ", "isbn": "123"}})
+	if len(resp.Errors) != 1 || resp.Errors[0].Extensions.Code != "BAD_USER_INPUT" || len(resp.Errors[0].Extensions.Fields) != 3 {
+		t.Errorf("invalid createBook: errors = %+v, want BAD_USER_INPUT with title, isbn and author fields", resp.Errors)
+	}
+	resp = gql(t, router, create, map[string]interface{}{"in": map[string]interface{}{"title": "Orphan", "authorId": "404"}})
+	if len(resp.Errors) != 1 || len(resp.Errors[0].Extensions.Fields) != 1 || resp.Errors[0].Extensions.Fields[0].Field != "authorId" {
+		t.Errorf("createBook with an unknown author: errors = %+v", resp.Errors)
+	}
+
+	const update = `mutation($id: ID!, $v: Int) { updateBook(id: $id, version: $v, input: {title: "The Go Book", authorId: "` + "%s" + `"}) { title version } }`
+	vars := map[string]interface{}{"id": created.ID, "v": 1}
+	resp = gql(t, router, strings.Replace(update, "%s", created.Author.ID, 1), vars)
+	if got := string(resp.Data["updateBook"]); got != `{"title":"The Go Book","version":2}` {
+		t.Errorf("updateBook = %s %+v", got, resp.Errors)
+	}
+	resp = gql(t, router, strings.Replace(update, "%s", created.Author.ID, 1), vars)
+	if len(resp.Errors) != 1 || resp.Errors[0].Extensions.Code != "CONFLICT" {
+		t.Errorf("updateBook at a stale version: errors = %+v, want CONFLICT", resp.Errors)
+	}
+
+	resp = gql(t, router, `mutation($id: ID!) { deleteBook(id: $id) }`, map[string]interface{}{"id": created.ID})
+	if string(resp.Data["deleteBook"]) != "true" {
+		t.Fatalf("deleteBook = %s %+v", resp.Data["deleteBook"], resp.Errors)
+	}
+	resp = gql(t, router, `mutation($id: ID!) { deleteBook(id: $id) }`, map[string]interface{}{"id": created.ID})
+	if len(resp.Errors) != 1 || resp.Errors[0].Extensions.Code != "GONE" {
+		t.Errorf("second deleteBook: errors = %+v, want GONE", resp.Errors)
+	}
+	if rec := do(t, router, "GET", "/api/books/"+created.ID, ""); rec.Code != http.StatusGone {
+		t.Errorf("REST GET after deleteBook = %d, want 410", rec.Code)
+	}
+}
+
+func TestGraphQLMutationsNeedAnEditor(t *testing.T) {
+	useStore(t)
+	router := newRouter()
+	const mutation = `mutation { createBook(input: {title: "x", author: {lastname: "y"}}) { id } }`
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query":`+jsonString(mutation)+`}`)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("mutation without credentials = %d, want 401", rec.Code)
+	}
+	if rec := do(t, router, "GET", "/graphql?query="+url.QueryEscape(mutation), ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("mutation over GET = %d, want 405", rec.Code)
+	}
+	books, _ := store.List()
+	if len(books) != 0 {
+		t.Errorf("refused mutations created %+v", books)
+	}
+
+	req := httptest.NewRequest("POST", "/graphql", strings.NewReader(mutation))
+	req.Header.Set("Content-Type", "application/graphql")
+	req.Header.Set("X-API-Key", testAPIKey)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"createBook":{"id"`) {
+		t.Errorf("application/graphql mutation = %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestGraphQLDepthLimit(t *testing.T) {
+	useStore(t)
+	router := newRouter()
+
+	deep := `{ authors { books { author { books { author { books { author { books { id } } } } } } } } }`
+	rec := do(t, router, "POST", "/graphql", `{"query":`+jsonString(deep)+`}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "BAD_USER_INPUT") {
+		t.Errorf("9 levels = %d %s, want 400", rec.Code, rec.Body)
+	}
+
+	// fragments count at the depth they are spread, and can't hide a cycle
+	looped := `{ authors { ...f } } fragment f on Author { books { author { ...f } } }`
+	rec = do(t, router, "POST", "/graphql", `{"query":`+jsonString(looped)+`}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("self-spreading fragment = %d %s, want 400", rec.Code, rec.Body)
+	}
+
+	shallow := `{ authors { books { author { books { id } } } } }`
+	if resp := gql(t, router, shallow, nil); len(resp.Errors) != 0 {
+		t.Errorf("5 levels: errors = %+v", resp.Errors)
+	}
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rest/bookspb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcWrites are the BookService methods that need the editor role and
+// count against the write limit; the rest are reads
+var grpcWrites = map[string]bool{
+	bookspb.BookService_CreateBook_FullMethodName: true,
+	bookspb.BookService_UpdateBook_FullMethodName: true,
+	bookspb.BookService_DeleteBook_FullMethodName: true,
+}
+
+// newGRPCServer serves BookService against the package-level store, with
+// the same credentials and per-client rate limits as the REST routes
+func newGRPCServer() *grpc.Server {
+	// every method gets its own per-client rate limit, like every route
+	desc := bookspb.BookService_ServiceDesc
+	var methods []string
+	for _, m := range desc.Methods {
+		methods = append(methods, "/"+desc.ServiceName+"/"+m.MethodName)
+	}
+	for _, s := range desc.Streams {
+		methods = append(methods, "/"+desc.ServiceName+"/"+s.StreamName)
+	}
+	limiters := map[string]*rateLimiter{}
+	for _, method := range methods {
+		spec := readLimit
+		if grpcWrites[method] {
+			spec = writeLimit
+		}
+		if spec.rate > 0 {
+			limiters[method] = newRateLimiter(spec)
+		}
+	}
+	guard := func(ctx context.Context, method string) (context.Context, error) {
+		if l := limiters[method]; l != nil {
+			if ok, _, _, retry := l.allow(grpcClientKey(ctx)); !ok {
+				return ctx, status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry in %ds", ceilSeconds(retry))
+			}
+		}
+		if !grpcWrites[method] {
+			return ctx, nil
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		p, err := auth.credentials(first(md.Get("x-api-key")), first(md.Get("authorization")))
+		if err != nil {
+			return ctx, status.Error(codes.Unauthenticated, "this needs a valid bearer token or API key: "+err.Error())
+		}
+		if !p.has(roleEditor) {
+			return ctx, status.Error(codes.PermissionDenied, "this needs the "+roleEditor+" role")
+		}
+		return context.WithValue(ctx, principalKey{}, p), nil
+	}
+
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := guard(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return h(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, h grpc.StreamHandler) error {
+			if _, err := guard(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return h(srv, ss)
+		}),
+	)
+	bookspb.RegisterBookServiceServer(srv, bookService{})
+	return srv
+}
+
+// serveGRPC runs srv on ln until ctx is cancelled, then lets in-flight
+// calls finish. Watch streams never do, so they are cut off after drain.
+func serveGRPC(ctx context.Context, srv *grpc.Server, ln net.Listener, drain time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(drain):
+		srv.Stop()
+	}
+	return <-errc
+}
+
+// grpcClientKey is clientKey for gRPC calls
+func grpcClientKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var host string
+	if p, ok := peer.FromContext(ctx); ok {
+		host = p.Addr.String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	return limitKey(first(md.Get("x-api-key")), host)
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// bookService implements bookspb.BookServiceServer
+type bookService struct {
+	bookspb.UnimplementedBookServiceServer
+}
+
+func (bookService) ListBooks(ctx context.Context, req *bookspb.ListBooksRequest) (*bookspb.ListBooksResponse, error) {
+	values := url.Values{}
+	for name, v := range map[string]string{"author": req.Author, "title": req.Title, "isbn": req.Isbn, "sort": req.Sort} {
+		if v != "" {
+			values.Set(name, v)
+		}
+	}
+	if req.Limit != 0 {
+		values.Set("limit", strconv.Itoa(int(req.Limit)))
+	}
+	if req.Offset != 0 {
+		values.Set("offset", strconv.Itoa(int(req.Offset)))
+	}
+	q, err := parseListQuery(values)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	books, err := store.List()
+	if err == nil {
+		books, err = withAuthors(books)
+	}
+	if err != nil {
+		return nil, grpcStoreError(err, "")
+	}
+	page, total := q.apply(books)
+	resp := &bookspb.ListBooksResponse{Total: int32(total)}
+	for _, b := range page {
+		resp.Books = append(resp.Books, bookToProto(b))
+	}
+	return resp, nil
+}
+
+func (bookService) GetBook(ctx context.Context, req *bookspb.GetBookRequest) (*bookspb.Book, error) {
+	book, err := store.Get(req.Id)
+	if err != nil {
+		return nil, grpcStoreError(err, req.Id)
+	}
+	return expandedProto(book)
+}
+
+func (bookService) CreateBook(ctx context.Context, req *bookspb.CreateBookRequest) (*bookspb.Book, error) {
+	book, err := bookFromProto(ctx, req.Book)
+	if err != nil {
+		return nil, err
+	}
+	book, err = insertBook(book)
+	if err != nil {
+		return nil, grpcStoreError(err, "")
+	}
+	return expandedProto(book)
+}
+
+func (bookService) UpdateBook(ctx context.Context, req *bookspb.UpdateBookRequest) (*bookspb.Book, error) {
+	if req.Book.GetId() == "" {
+		return nil, invalidArgument(ValidationErrors{{Field: "book.id", Message: "is required"}})
+	}
+	book, err := bookFromProto(ctx, req.Book)
+	if err != nil {
+		return nil, err
+	}
+	book.ID, book.Version = req.Book.Id, int(req.Book.Version)
+	book, err = store.Update(book.ID, book)
+	if err != nil {
+		return nil, grpcStoreError(err, req.Book.Id)
+	}
+	return expandedProto(book)
+}
+
+func (bookService) DeleteBook(ctx context.Context, req *bookspb.DeleteBookRequest) (*bookspb.DeleteBookResponse, error) {
+	p, _ := principalFrom(ctx)
+	if err := store.Delete(req.Id, int(req.Version), p.Subject); err != nil {
+		return nil, grpcStoreError(err, req.Id)
+	}
+	return &bookspb.DeleteBookResponse{}, nil
+}
+
+// WatchBooks streams the event bus as getBookEvents does, catching up from
+// after_id first. A client that falls behind is caught up from the bus's
+// memory rather than dropped.
+func (bookService) WatchBooks(req *bookspb.WatchBooksRequest, stream bookspb.BookService_WatchBooksServer) error {
+	// subscribe before catching up so nothing falls in between
+	ch, cancel := events.subscribe(64)
+	defer func() { cancel() }()
+	missed := events.since(req.AfterId)
+
+	var last uint64
+	lastID := req.AfterId
+	send := func(e Event) error {
+		seq, _ := events.sequence(e.ID)
+		if seq <= last {
+			return nil // already sent while catching up
+		}
+		last, lastID = seq, e.ID
+		return stream.Send(&bookspb.BookEvent{
+			Id:   e.ID,
+			Type: string(e.Type),
+			At:   timestamppb.New(e.At),
+			By:   e.By,
+			Book: bookToProto(e.Book),
+		})
+	}
+	for _, e := range missed {
+		if err := send(e); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				ch, cancel = events.subscribe(64)
+				missed = events.since(lastID)
+				for _, e := range missed {
+					if err := send(e); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := send(e); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// expandedProto is bookToProto with the book's author filled in
+func expandedProto(book Book) (*bookspb.Book, error) {
+	expanded, err := withAuthors([]Book{book})
+	if err != nil {
+		return nil, grpcStoreError(err, book.ID)
+	}
+	return bookToProto(expanded[0]), nil
+}
+
+func bookToProto(b Book) *bookspb.Book {
+	pb := &bookspb.Book{
+		Id:        b.ID,
+		Isbn:      b.Isbn,
+		Title:     b.Title,
+		AuthorId:  b.AuthorID,
+		Version:   int32(b.Version),
+		UpdatedBy: b.UpdatedBy,
+	}
+	if !b.UpdatedAt.IsZero() {
+		pb.UpdatedAt = timestamppb.New(b.UpdatedAt)
+	}
+	if b.Author != nil {
+		pb.Author = &bookspb.Author{Id: b.Author.ID, Firstname: b.Author.Firstname, Lastname: b.Author.Lastname}
+	}
+	return pb
+}
+
+// bookFromProto is readBook for gRPC: it validates pb and resolves its
+// author, and notes who is making the change
+func bookFromProto(ctx context.Context, pb *bookspb.Book) (Book, error) {
+	book := Book{Isbn: pb.GetIsbn(), Title: pb.GetTitle(), AuthorID: pb.GetAuthorId()}
+	if a := pb.GetAuthor(); a != nil && book.AuthorID == "" {
+		book.Author = &Author{Firstname: a.Firstname, Lastname: a.Lastname}
+	}
+	if err := book.Validate(); err != nil {
+		return Book{}, invalidArgument(err.(ValidationErrors))
+	}
+	if err := resolveAuthor(&book); err != nil {
+		return Book{}, grpcStoreError(err, "")
+	}
+	p, _ := principalFrom(ctx)
+	book.UpdatedBy = p.Subject
+	return book, nil
+}
+
+// invalidArgument reports field errors as a BadRequest detail, the
+// standard place for them in a gRPC status
+func invalidArgument(errs ValidationErrors) error {
+	br := &errdetails.BadRequest{}
+	for _, e := range errs {
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: e.Field, Description: e.Message})
+	}
+	st, err := status.New(codes.InvalidArgument, "invalid book: "+errs.Error()).WithDetails(br)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "invalid book: "+errs.Error())
+	}
+	return st.Err()
+}
+
+// grpcStoreError is storeError for gRPC
+func grpcStoreError(err error, id string) error {
+	switch {
+	case errors.Is(err, ErrBookDeleted):
+		return status.Error(codes.NotFound, "book "+id+" has been deleted")
+	case errors.Is(err, ErrBookNotFound):
+		return status.Error(codes.NotFound, "no book with id "+id)
+	case errors.Is(err, ErrAuthorNotFound):
+		return invalidArgument(ValidationErrors{{Field: "author_id", Message: "no author has this id"}})
+	case errors.Is(err, ErrVersionConflict):
+		return status.Error(codes.Aborted, "the book has been changed since you fetched it")
+	}
+	log.Printf("grpc: %v", err)
+	return status.Error(codes.Internal, "the book store failed, please try again later")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rest/bookspb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newGRPCClient serves BookService on an in-memory listener and returns a
+// client connected to it
+func newGRPCClient(t *testing.T) bookspb.BookServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := newGRPCServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return bookspb.NewBookServiceClient(conn)
+}
+
+// asEditor adds the test editor's API key to ctx
+func asEditor(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "x-api-key", testAPIKey)
+}
+
+func TestGRPCBookService(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Go in Action", Author: &Author{Firstname: "Bill", Lastname: "Kennedy"}})
+	c := newGRPCClient(t)
+	ctx := asEditor(context.Background())
+
+	created, err := c.CreateBook(ctx, &bookspb.CreateBookRequest{Book: &bookspb.Book{
+		Isbn: "0306406152", Title: "Concurrency in Go", Author: &bookspb.Author{Firstname: "Katherine", Lastname: "Cox-Buday"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id == "" || created.Version != 1 || created.AuthorId == "" || created.Author.GetLastname() != "Cox-Buday" || created.UpdatedBy != "apikey:tests" || created.UpdatedAt == nil {
+		t.Errorf("CreateBook = %v", created)
+	}
+
+	got, err := c.GetBook(context.Background(), &bookspb.GetBookRequest{Id: created.Id})
+	if err != nil || got.Title != "Concurrency in Go" || got.Author.GetFirstname() != "Katherine" {
+		t.Errorf("GetBook = %v, %v", got, err)
+	}
+	list, err := c.ListBooks(context.Background(), &bookspb.ListBooksRequest{Sort: "-title", Limit: 1})
+	if err != nil || list.Total != 2 || len(list.Books) != 1 || list.Books[0].Id != "1" {
+		t.Errorf("ListBooks(sort -title, limit 1) = %v, %v", list, err)
+	}
+	if _, err := c.ListBooks(context.Background(), &bookspb.ListBooksRequest{Sort: "author"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListBooks with a bad sort: %v, want InvalidArgument", err)
+	}
+
+	updated, err := c.UpdateBook(ctx, &bookspb.UpdateBookRequest{Book: &bookspb.Book{Id: created.Id, Version: 1, Title: "Concurrency in Go, 2nd ed.", AuthorId: created.AuthorId}})
+	if err != nil || updated.Version != 2 || updated.Author.GetLastname() != "Cox-Buday" {
+		t.Errorf("UpdateBook = %v, %v", updated, err)
+	}
+	if _, err := c.UpdateBook(ctx, &bookspb.UpdateBookRequest{Book: &bookspb.Book{Id: created.Id, Version: 1, Title: "Stale", AuthorId: created.AuthorId}}); status.Code(err) != codes.Aborted {
+		t.Errorf("UpdateBook at a stale version: %v, want Aborted", err)
+	}
+
+	_, err = c.CreateBook(ctx, &bookspb.CreateBookRequest{Book: &bookspb.Book{Isbn: "123"}})
+	var fields []string
+	for _, d := range status.Convert(err).Details() {
+		if br, ok := d.(*errdetails.BadRequest); ok {
+			for _, v := range br.FieldViolations {
+				fields = append(fields, v.Field)
+			}
+		}
+	}
+	if status.Code(err) != codes.InvalidArgument || len(fields) != 3 {
+		t.Errorf("CreateBook with an invalid book: %v, field violations %v, want InvalidArgument for title, isbn and author", err, fields)
+	}
+
+	if _, err := c.DeleteBook(ctx, &bookspb.DeleteBookRequest{Id: created.Id, Version: 1}); status.Code(err) != codes.Aborted {
+		t.Errorf("DeleteBook at a stale version: %v, want Aborted", err)
+	}
+	if _, err := c.DeleteBook(ctx, &bookspb.DeleteBookRequest{Id: created.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetBook(context.Background(), &bookspb.GetBookRequest{Id: created.Id}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetBook after DeleteBook: %v, want NotFound", err)
+	}
+	if history, _ := store.History(created.Id); len(history) != 3 || history[2].By != "apikey:tests" {
+		t.Errorf("history = %+v, want create, update and delete by the editor", history)
+	}
+}
+
+func TestGRPCWritesNeedAnEditor(t *testing.T) {
+	useStore(t)
+	saved := auth
+	defer func() { auth = saved }()
+	auth, _ = newAuthenticator("", "importer:imp0rt:editor,dashboard:d4sh:reader")
+	c := newGRPCClient(t)
+	req := &bookspb.CreateBookRequest{Book: &bookspb.Book{Title: "New", Author: &bookspb.Author{Lastname: "Smith"}}}
+
+	for _, tc := range []struct {
+		key  string
+		want codes.Code
+	}{
+		{"", codes.Unauthenticated},
+		{"nope", codes.Unauthenticated},
+		{"d4sh", codes.PermissionDenied},
+		{"imp0rt", codes.OK},
+	} {
+		ctx := context.Background()
+		if tc.key != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", tc.key)
+		}
+		if _, err := c.CreateBook(ctx, req); status.Code(err) != tc.want {
+			t.Errorf("CreateBook with key %q: %v, want %s", tc.key, err, tc.want)
+		}
+	}
+	if _, err := c.ListBooks(context.Background(), &bookspb.ListBooksRequest{}); err != nil {
+		t.Errorf("ListBooks without credentials: %v", err)
+	}
+}
+
+func TestGRPCWatchBooks(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Lastname: "Smith"}})
+	store = publishChanges(store)
+	c := newGRPCClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := c.WatchBooks(ctx, &bookspb.WatchBooksRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stream is only subscribed once the server has seen the call, so
+	// keep changing the book until the first change comes through
+	var first *bookspb.BookEvent
+	received := make(chan *bookspb.BookEvent)
+	go func() {
+		for {
+			e, err := stream.Recv()
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- e
+		}
+	}()
+	for first == nil {
+		if _, err := c.UpdateBook(asEditor(ctx), &bookspb.UpdateBookRequest{Book: &bookspb.Book{Id: "1", Title: "Sample book", Author: &bookspb.Author{Lastname: "Smith"}}}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case first = <-received:
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if first.Type != string(BookUpdated) || first.Book.GetId() != "1" || first.By != "apikey:tests" || first.Id == "" {
+		t.Fatalf("first event = %v", first)
+	}
+
+	if _, err := c.DeleteBook(asEditor(ctx), &bookspb.DeleteBookRequest{Id: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	var deleted *bookspb.BookEvent
+	for e := range received {
+		if e.Type == string(BookDeleted) {
+			deleted = e
+			break
+		}
+	}
+	if deleted == nil || deleted.Book.GetId() != "1" {
+		t.Fatalf("no book.deleted event, got %v", deleted)
+	}
+
+	// a new watch catches up from the first event
+	resumed, err := c.WatchBooks(ctx, &bookspb.WatchBooksRequest{AfterId: first.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		e, err := resumed.Recv()
+		if err != nil {
+			t.Fatalf("resumed watch: %v, want it to replay the delete", err)
+		}
+		if e.Id == first.Id {
+			t.Fatal("resumed watch replayed the event it resumed after")
+		}
+		if e.Id == deleted.Id {
+			break
+		}
+	}
+}
+
+func TestGRPCRateLimitIgnoresMadeUpKeys(t *testing.T) {
+	useStore(t)
+	saved := readLimit
+	defer func() { readLimit = saved }()
+	readLimit = rateSpec{rate: 0.001, burst: 2}
+	c := newGRPCClient(t)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.ListBooks(context.Background(), &bookspb.ListBooksRequest{}); err != nil {
+			t.Fatalf("ListBooks %d: %v", i+1, err)
+		}
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "made-up")
+	if _, err := c.ListBooks(ctx, &bookspb.ListBooksRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("ListBooks with a made-up key after the burst: %v, want ResourceExhausted", err)
+	}
+	if _, err := c.ListBooks(asEditor(context.Background()), &bookspb.ListBooksRequest{}); err != nil {
+		t.Errorf("ListBooks with a valid key: %v, want its own limit", err)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// pinger is implemented by stores that depend on something outside the
+// process, like a disk, that can stop working while we run
+type pinger interface {
+	Ping() error
+}
+
+// getHealthz is the liveness check: if we can answer at all, we're alive
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// getReadyz is the readiness check: we're only ready to take traffic while
+// the storage backend is reachable
+func getReadyz(w http.ResponseWriter, r *http.Request) {
+	if p, ok := store.(pinger); ok {
+		if err := p.Ping(); err != nil {
+			log.Printf("readiness check: %v", err)
+			writeProblem(w, r, http.StatusServiceUnavailable, "the book store is not reachable")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
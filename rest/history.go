@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Change is one entry in a book's history
+type Change struct {
+	Version int                  `json:"version"` // the book's version after the change
+	Action  string               `json:"action"`  // created, updated, deleted or undeleted
+	By      string               `json:"by,omitempty"`
+	At      time.Time            `json:"at"`
+	Diff    map[string]FieldDiff `json:"diff,omitempty"` // by JSON field name
+}
+
+// FieldDiff is a field's value before and after a change
+type FieldDiff struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// diffBooks lists the fields of a book that differ between before and after
+func diffBooks(before, after Book) map[string]FieldDiff {
+	diff := map[string]FieldDiff{}
+	field := func(name, a, b string) {
+		if a != b {
+			diff[name] = FieldDiff{Before: a, After: b}
+		}
+	}
+	field("isbn", before.Isbn, after.Isbn)
+	field("title", before.Title, after.Title)
+	field("author_id", before.AuthorID, after.AuthorID)
+	if len(diff) == 0 {
+		return nil
+	}
+	return diff
+}
+
+// getBookHistory lists the changes to a book, deleted or not
+func getBookHistory(w http.ResponseWriter, r *http.Request) {
+	changes, err := store.History(mux.Vars(r)["id"])
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+// undeleteBook brings back a deleted book that hasn't been purged yet
+func undeleteBook(w http.ResponseWriter, r *http.Request) {
+	book, err := store.Undelete(mux.Vars(r)["id"], actor(r))
+	if errors.Is(err, ErrAuthorNotFound) {
+		writeProblem(w, r, http.StatusConflict, "the book's author has been deleted since; create the author again first")
+		return
+	}
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	writeBook(w, r, http.StatusOK, book)
+}
+
+// purgeTombstones removes books deleted more than retention ago, every
+// interval until ctx is cancelled
+func purgeTombstones(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			purged, err := store.Purge(now.Add(-retention))
+			if err != nil {
+				log.Printf("purging deleted books: %v", err)
+			} else if purged > 0 {
+				log.Printf("purged %d books deleted more than %s ago", purged, retention)
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSoftDeleteAndUndelete(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Lastname: "Smith"}})
+	router := newRouter()
+
+	if rec := do(t, router, "DELETE", "/api/books/1", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d, want 204", rec.Code)
+	}
+	if rec := do(t, router, "GET", "/api/books/1", ""); rec.Code != http.StatusGone {
+		t.Errorf("GET after DELETE = %d, want 410", rec.Code)
+	}
+	if rec := do(t, router, "PUT", "/api/books/1", `{"title":"x","author":{"lastname":"Smith"}}`); rec.Code != http.StatusGone {
+		t.Errorf("PUT after DELETE = %d, want 410", rec.Code)
+	}
+	if rec := do(t, router, "DELETE", "/api/books/1", ""); rec.Code != http.StatusGone {
+		t.Errorf("second DELETE = %d, want 410", rec.Code)
+	}
+	var books []Book
+	json.NewDecoder(do(t, router, "GET", "/api/books", "").Body).Decode(&books)
+	if len(books) != 0 {
+		t.Errorf("list after DELETE = %+v, want empty", books)
+	}
+	if _, err := store.Create(Book{ID: "1", Title: "Reuse"}); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("Create with a deleted book's ID: error = %v, want ErrDuplicateID", err)
+	}
+
+	rec := do(t, router, "POST", "/api/books/1:undelete", "")
+	var restored Book
+	json.NewDecoder(rec.Body).Decode(&restored)
+	if rec.Code != http.StatusOK || restored.Title != "Sample book" || restored.Version != 2 || rec.Header().Get("ETag") != `"2"` {
+		t.Fatalf("undelete = %d %+v ETag %s, want 200 with version 2", rec.Code, restored, rec.Header().Get("ETag"))
+	}
+	if rec := do(t, router, "GET", "/api/books/1", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET after undelete = %d, want 200", rec.Code)
+	}
+	if rec := do(t, router, "POST", "/api/books/1:undelete", ""); rec.Code != http.StatusConflict {
+		t.Errorf("undelete of a book that is there = %d, want 409", rec.Code)
+	}
+	if rec := do(t, router, "POST", "/api/books/404:undelete", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("undelete of an unknown book = %d, want 404", rec.Code)
+	}
+}
+
+func TestUndeleteNeedsTheAuthor(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Lastname: "Smith"}})
+	router := newRouter()
+	authorID := storedBook(t, "1").AuthorID
+
+	do(t, router, "DELETE", "/api/books/1", "")
+	if rec := do(t, router, "DELETE", "/api/authors/"+authorID, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("deleting the author of a deleted book = %d, want 204", rec.Code)
+	}
+	if rec := do(t, router, "POST", "/api/books/1:undelete", ""); rec.Code != http.StatusConflict {
+		t.Errorf("undelete without the author = %d, want 409", rec.Code)
+	}
+}
+
+func TestBookHistory(t *testing.T) {
+	useStore(t)
+	router := newRouter()
+	rec := do(t, router, "POST", "/api/books", `{"title":"Draft","isbn":"0306406152","author":{"lastname":"Smith"}}`)
+	var created Book
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.UpdatedBy != "apikey:tests" || created.UpdatedAt.IsZero() {
+		t.Errorf("created book = %+v, want it stamped with who and when", created)
+	}
+	path := "/api/books/" + created.ID
+	do(t, router, "PUT", path, `{"title":"Final","isbn":"0306406152","author":{"lastname":"Smith"},"updated_by":"someone else"}`)
+	do(t, router, "DELETE", path, "")
+	do(t, router, "POST", path+":undelete", "")
+
+	rec = do(t, router, "GET", path+"/history", "")
+	var changes []Change
+	json.NewDecoder(rec.Body).Decode(&changes)
+	if rec.Code != http.StatusOK || len(changes) != 4 {
+		t.Fatalf("history = %d %+v, want 200 with 4 changes", rec.Code, changes)
+	}
+	wantActions := []string{"created", "updated", "deleted", "undeleted"}
+	wantVersions := []int{1, 2, 2, 3}
+	for i, c := range changes {
+		if c.Action != wantActions[i] || c.Version != wantVersions[i] || c.By != "apikey:tests" || c.At.IsZero() {
+			t.Errorf("change %d = %+v, want %s at version %d by apikey:tests", i, c, wantActions[i], wantVersions[i])
+		}
+	}
+	if d := changes[0].Diff["title"]; d.Before != "" || d.After != "Draft" {
+		t.Errorf("created diff = %+v, want the title from nothing to Draft", changes[0].Diff)
+	}
+	if d := changes[1].Diff; len(d) != 1 || d["title"] != (FieldDiff{Before: "Draft", After: "Final"}) {
+		t.Errorf("updated diff = %+v, want just the title from Draft to Final", d)
+	}
+
+	if rec := do(t, router, "GET", "/api/books/404/history", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("history of an unknown book = %d, want 404", rec.Code)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	s := newMemoryStore()
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return clock }
+	s.Create(Book{ID: "old", Title: "Old"})
+	s.Create(Book{ID: "new", Title: "New"})
+	s.Delete("old", 0, "")
+	clock = clock.Add(48 * time.Hour)
+	s.Delete("new", 0, "")
+
+	purged, err := s.Purge(clock.Add(-24 * time.Hour))
+	if err != nil || purged != 1 {
+		t.Fatalf("Purge = %d, %v, want 1", purged, err)
+	}
+	if _, err := s.Get("old"); err != ErrBookNotFound {
+		t.Errorf(`Get("old") after purge: error = %v, want ErrBookNotFound`, err)
+	}
+	if _, err := s.History("old"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf(`History("old") after purge: error = %v, want ErrBookNotFound`, err)
+	}
+	if _, err := s.Undelete("new", ""); err != nil {
+		t.Errorf(`Undelete("new"), deleted within the retention period: %v`, err)
+	}
+}
+
+func TestPurgeTombstonesRunsUntilCancelled(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Lastname: "Smith"}})
+	store.Delete("1", 0, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		purgeTombstones(ctx, time.Nanosecond, time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := store.History("1"); errors.Is(err, ErrBookNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the deleted book was never purged")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func TestFileStoreKeepsTombstonesAndHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.json")
+	s, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Create(Book{ID: "1", Title: "First", UpdatedBy: "alice"})
+	s.Update("1", Book{ID: "1", Title: "Second", UpdatedBy: "bob"})
+	s.Delete("1", 0, "carol")
+
+	reopened, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := reopened.History("1")
+	if err != nil || len(changes) != 3 || changes[1].By != "bob" || changes[2].By != "carol" {
+		t.Fatalf("reopened history = %+v, %v, want alice, bob and carol's changes", changes, err)
+	}
+	book, err := reopened.Undelete("1", "dave")
+	if err != nil || book.Title != "Second" || book.UpdatedBy != "dave" {
+		t.Errorf("Undelete after reopening = %+v, %v, want Second restored by dave", book, err)
+	}
+}
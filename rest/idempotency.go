@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotency remembers the responses to POSTs made with an
+// Idempotency-Key header, so a client retrying one after a timeout gets the
+// book it created the first time rather than a second copy. nil, the
+// default, ignores the header. main sets it up from the config.
+var idempotency *idempotencyKeys
+
+// maxIdempotencyKey is the longest Idempotency-Key accepted
+const maxIdempotencyKey = 255
+
+// errKeyReused is returned for an Idempotency-Key already used for a
+// different request
+var errKeyReused = errors.New("idempotency key reused for a different request")
+
+// replayedHeaders are the response headers replayed with a stored response
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// idempotencyKeys holds a response for each key it has seen within the
+// last window. Keys belong to whoever used them, so clients can't see each
+// other's responses by guessing keys.
+type idempotencyKeys struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]*keyedResponse
+	byStart *list.List // of *keyedResponse, oldest first, for expiring them
+}
+
+// keyedResponse is the response to the first request made with a key. done
+// is closed once it is known; until then, repeats wait for it.
+type keyedResponse struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	el          *list.Element
+	done        chan struct{}
+
+	status int
+	header http.Header
+	body   []byte
+	failed bool // the request failed in a way worth retrying, so it's forgotten
+}
+
+func newIdempotencyKeys(window time.Duration) *idempotencyKeys {
+	return &idempotencyKeys{
+		window:  window,
+		now:     time.Now,
+		keys:    map[string]*keyedResponse{},
+		byStart: list.New(),
+	}
+}
+
+// begin returns the response already made for key and a request with the
+// given fingerprint, waiting for it if it isn't finished yet, or, if there
+// is none, a new one that the caller must finish. Reusing key for a
+// different request is errKeyReused.
+func (k *idempotencyKeys) begin(ctx context.Context, key string, fingerprint [sha256.Size]byte) (*keyedResponse, bool, error) {
+	for {
+		k.mu.Lock()
+		now := k.now()
+		for el := k.byStart.Front(); el != nil && !now.Before(el.Value.(*keyedResponse).expires); el = k.byStart.Front() {
+			k.forget(el.Value.(*keyedResponse))
+		}
+		kr, ok := k.keys[key]
+		if !ok {
+			kr = &keyedResponse{key: key, fingerprint: fingerprint, expires: now.Add(k.window), done: make(chan struct{})}
+			kr.el = k.byStart.PushBack(kr)
+			k.keys[key] = kr
+			k.mu.Unlock()
+			return kr, true, nil
+		}
+		k.mu.Unlock()
+		if kr.fingerprint != fingerprint {
+			return nil, false, errKeyReused
+		}
+		select {
+		case <-kr.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if !kr.failed {
+			return kr, false, nil
+		}
+		// the first attempt didn't stick, so this one gets to try again
+	}
+}
+
+// finish records the response to kr's request and hands it to any repeats
+// waiting for it. A 5xx is forgotten, so the request can be retried.
+func (k *idempotencyKeys) finish(kr *keyedResponse, status int, header http.Header, body []byte) {
+	kr.status, kr.header, kr.body = status, header, body
+	kr.failed = status >= 500
+	if kr.failed {
+		k.mu.Lock()
+		k.forget(kr)
+		k.mu.Unlock()
+	}
+	close(kr.done)
+}
+
+func (k *idempotencyKeys) forget(kr *keyedResponse) {
+	if k.keys[kr.key] == kr {
+		delete(k.keys, kr.key)
+	}
+	k.byStart.Remove(kr.el)
+}
+
+// idempotent makes h safe to retry with an Idempotency-Key header: the
+// first request with a key is served by h, and later ones with the same
+// key and body within the window get its response again, marked with
+// Idempotent-Replayed, without h seeing them. Repeats that arrive while the
+// first is still being served wait for it. The same key with a different
+// body is a mistake, answered with a 422.
+func idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		k := idempotency
+		if k == nil || key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeProblem(w, r, http.StatusBadRequest, "the Idempotency-Key header is too long")
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			badBody(w, r, "readable", err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+
+		kr, first, err := k.begin(r.Context(), actor(r)+"\x00"+key, fingerprint(data))
+		if errors.Is(err, errKeyReused) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "this Idempotency-Key was already used with a different request body")
+			return
+		}
+		if err != nil {
+			return // the client gave up waiting
+		}
+		if !first {
+			for name, values := range kr.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(kr.status)
+			w.Write(kr.body)
+			return
+		}
+
+		rec := &teeResponse{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			// a panic counts as a failure, so the waiting repeats aren't stuck
+			if p := recover(); p != nil {
+				k.finish(kr, http.StatusInternalServerError, nil, nil)
+				panic(p)
+			}
+			header := http.Header{}
+			for _, name := range replayedHeaders {
+				if values := w.Header().Values(name); len(values) > 0 {
+					header[http.CanonicalHeaderKey(name)] = values
+				}
+			}
+			k.finish(kr, rec.status, header, rec.body.Bytes())
+		}()
+		h(rec, r)
+	}
+}
+
+// fingerprint identifies a request body. JSON bodies that differ only in
+// spacing or the order of their keys are the same request.
+func fingerprint(body []byte) [sha256.Size]byte {
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil {
+		if canonical, err := json.Marshal(v); err == nil {
+			body = canonical
+		}
+	}
+	return sha256.Sum256(body)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useIdempotency honours Idempotency-Key headers for the rest of the test
+func useIdempotency(t *testing.T) *idempotencyKeys {
+	t.Helper()
+	idempotency = newIdempotencyKeys(time.Hour)
+	t.Cleanup(func() { idempotency = nil })
+	return idempotency
+}
+
+func postWithKey(router http.Handler, key, apiKey, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/books", strings.NewReader(body))
+	req.Header.Set("X-API-Key", apiKey)
+	req.Header.Set("Idempotency-Key", key)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCreateBookIdempotencyKey(t *testing.T) {
+	useStore(t)
+	keys := useIdempotency(t)
+	now := time.Now()
+	keys.now = func() time.Time { return now }
+	saved := auth
+	defer func() { auth = saved }()
+	auth, _ = newAuthenticator("", "tests:"+testAPIKey+":editor,other:0th3r:editor")
+	router := newRouter()
+	created := func(rec *httptest.ResponseRecorder) string {
+		t.Helper()
+		var b Book
+		if err := json.NewDecoder(rec.Body).Decode(&b); err != nil || rec.Code != http.StatusCreated {
+			t.Fatalf("POST = %d %v", rec.Code, err)
+		}
+		return b.ID
+	}
+	body := `{"title":"Go in Action","author":{"lastname":"Kennedy"}}`
+
+	first := postWithKey(router, "k1", testAPIKey, body)
+	id := created(first)
+	if first.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("the first request was marked as replayed")
+	}
+	// the same body, spaced and ordered differently
+	again := postWithKey(router, "k1", testAPIKey, `{ "author": {"lastname": "Kennedy"}, "title": "Go in Action" }`)
+	if got := created(again); got != id || again.Header().Get("Idempotent-Replayed") != "true" || again.Header().Get("Location") != first.Header().Get("Location") {
+		t.Errorf("repeat = %s, replayed %q, Location %q; want book %s replayed", got, again.Header().Get("Idempotent-Replayed"), again.Header().Get("Location"), id)
+	}
+	if books, _ := store.List(); len(books) != 1 {
+		t.Errorf("%d books stored, want 1", len(books))
+	}
+
+	if rec := postWithKey(router, "k1", testAPIKey, `{"title":"Something else","author":{"lastname":"Kennedy"}}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("same key, different body = %d, want 422", rec.Code)
+	}
+	if got := created(postWithKey(router, "k2", testAPIKey, body)); got == id {
+		t.Error("a new key replayed the old key's book")
+	}
+	if got := created(postWithKey(router, "k1", "0th3r", body)); got == id {
+		t.Error("another client's key replayed the first client's book")
+	}
+	if rec := postWithKey(router, strings.Repeat("k", maxIdempotencyKey+1), testAPIKey, body); rec.Code != http.StatusBadRequest {
+		t.Errorf("overlong key = %d, want 400", rec.Code)
+	}
+
+	// errors in the request are replayed too
+	if rec := postWithKey(router, "k3", testAPIKey, `{"title":""}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid book = %d", rec.Code)
+	}
+	if rec := postWithKey(router, "k3", testAPIKey, `{"title":""}`); rec.Code != http.StatusUnprocessableEntity || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("repeated invalid book = %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+
+	now = now.Add(time.Hour)
+	if got := created(postWithKey(router, "k1", testAPIKey, body)); got == id {
+		t.Error("a key was replayed after the window")
+	}
+}
+
+func TestIdempotentWaitsForTheFirstRequest(t *testing.T) {
+	useIdempotency(t)
+	var calls int32
+	release := make(chan struct{})
+	h := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		<-release
+		writeJSON(w, http.StatusCreated, map[string]int32{"call": n})
+	})
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := editorRequest("POST", "/api/books", `{"title":"Go"}`)
+			req.Header.Set("Idempotency-Key", "same")
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			bodies[i] = strconv.Itoa(rec.Code) + " " + rec.Body.String()
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond) // let them all arrive
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("handler called %d times, want once", calls)
+	}
+	for _, b := range bodies {
+		if b != bodies[0] || !strings.HasPrefix(b, "201 ") {
+			t.Errorf("responses differ: %q", bodies)
+			break
+		}
+	}
+}
+
+func TestIdempotentForgetsServerErrors(t *testing.T) {
+	useIdempotency(t)
+	status := http.StatusInternalServerError
+	h := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+	send := func() int {
+		req := editorRequest("POST", "/api/books", `{}`)
+		req.Header.Set("Idempotency-Key", "retry-me")
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+	send()
+	status = http.StatusCreated
+	if got := send(); got != http.StatusCreated {
+		t.Errorf("retry after a 500 = %d, want it to run again", got)
+	}
+	status = http.StatusBadGateway
+	if got := send(); got != http.StatusCreated {
+		t.Errorf("second retry = %d, want the 201 replayed", got)
+	}
+}
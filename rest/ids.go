@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// IDGenerator hands out IDs for newly created books. The store still has the
+// final say: Create rejects an ID that is already taken and the caller asks
+// for another one.
+type IDGenerator interface {
+	NewID() string
+}
+
+// newIDGenerator returns the generator selected at startup ("uuid" or
+// "sequence"). A sequence starts after the highest numeric ID already taken
+// so a reopened file store doesn't hand out old IDs again.
+func newIDGenerator(kind string, taken []string) (IDGenerator, error) {
+	switch kind {
+	case "uuid":
+		return uuidGenerator{}, nil
+	case "sequence":
+		var last uint64
+		for _, id := range taken {
+			if n, err := strconv.ParseUint(id, 10, 64); err == nil && n > last {
+				last = n
+			}
+		}
+		return &sequenceGenerator{last: last}, nil
+	default:
+		return nil, fmt.Errorf("unknown id generator %q (want uuid or sequence)", kind)
+	}
+}
+
+// uuidGenerator produces random (version 4) UUIDs
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand only fails if the OS has no entropy source
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// sequenceGenerator counts up from 1 (or from where it was told to start)
+type sequenceGenerator struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+func (g *sequenceGenerator) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.last++
+	return strconv.FormatUint(g.last, 10)
+}
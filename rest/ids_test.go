@@ -0,0 +1,33 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestUUIDGenerator(t *testing.T) {
+	want := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := uuidGenerator{}.NewID()
+		if !want.MatchString(id) {
+			t.Fatalf("NewID() = %q, want a version 4 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("NewID() returned %q twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestSequenceGeneratorStartsAfterExistingIDs(t *testing.T) {
+	g, err := newIDGenerator("sequence", []string{"7", "abc", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"8", "9", "10"} {
+		if got := g.NewID(); got != want {
+			t.Errorf("NewID() = %q, want %q", got, want)
+		}
+	}
+}
@@ -1,102 +1,402 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
-	"math/rand"
+	"net"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gorilla/mux"
+	"github.com/rest/model"
 )
 
-// the model (Book and Author structs)
-type Book struct {
-	ID 		string `json:"id"`
-	Isbn 	string `json:"isbn"`
-	Title 	string `json:"title"`
-	Author 	*Author `json:"author"`
-}
+// the model (Book and Author structs) lives in its own package so the
+// client can share it
+type (
+	Book             = model.Book
+	Author           = model.Author
+	FieldError       = model.FieldError
+	ValidationErrors = model.ValidationErrors
+)
+
+// store holds the books and authors; the backend is picked with -store
+var store BookStore
 
+// ids mints the ID of every created book and author; picked with -ids
+var ids IDGenerator = uuidGenerator{}
 
-type Author struct {
-	Firstname string `json:"firstname"`
-	Lastname string `json:"lastname"`
+func getBooks(w http.ResponseWriter, r *http.Request) {
+	q, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	books, err := store.List()
+	if err == nil {
+		// needed to filter by author even when the response leaves them out
+		books, err = withAuthors(books)
+	}
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	page, total := q.apply(books)
+	setPageHeaders(w, r, q, total)
+	writeJSON(w, http.StatusOK, present(r, page))
 }
 
-// Init books var as a slice Book struct
-var books []Book 
+func getBook(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r) // get params
+	book, err := store.Get(params["id"])
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	presented := presentBook(r, book)
+	tag := presentedETag(presented)
+	w.Header().Set("ETag", tag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && weakMatch(inm, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, presented)
+}
 
-func getBooks(w http.ResponseWriter, r *http.Request){
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(books)
+func createBook(w http.ResponseWriter, r *http.Request) {
+	book, ok := readBook(w, r)
+	if !ok {
+		return
+	}
+	book.UpdatedBy = actor(r)
+	book, err := insertBook(book)
+	if err != nil {
+		bookWriteError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", apiPrefix(r)+"/books/"+book.ID)
+	writeBook(w, r, http.StatusCreated, book)
 }
 
-func getBook(w http.ResponseWriter, r *http.Request){
-	w.Header().Set("Content-Type", "application/json")
-	params := mux.Vars(r) // get params
-	// Loop over books collection and find the matching ID
-	for _, item := range(books) {
-		if item.ID == params["id"] {
-			json.NewEncoder(w).Encode(item)
-			return
+// wrapStore wraps s so its changes drop the cached responses they make out
+// of date, if there is a cache, and are then published. Invalidating
+// first means whoever hears of a change and reads the book straight away
+// gets the new answer, not a cached one.
+func wrapStore(s BookStore, cache *responseCache) BookStore {
+	if cache != nil {
+		s = invalidateResponses(s, cache)
+	}
+	return publishChanges(s)
+}
+
+// insertBook stores book under a fresh ID, asking for another one in the
+// unlikely case the generator comes up with an ID that is already taken
+func insertBook(book Book) (Book, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		book.ID = ids.NewID()
+		created, err := store.Create(book)
+		if !errors.Is(err, ErrDuplicateID) {
+			return created, err
 		}
 	}
-	json.NewEncoder(w).Encode(&Book{})
+	return Book{}, errors.New("could not generate a unique book id")
+}
 
+func updateBook(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	book, ok := readBook(w, r)
+	if !ok {
+		return
+	}
+	version, ok := checkIfMatch(w, r, params["id"])
+	if !ok {
+		return
+	}
+	book.ID = params["id"] // the path decides which book this is, not the body
+	book.Version = version
+	book.UpdatedBy = actor(r)
+	book, err := store.Update(params["id"], book)
+	if err != nil {
+		bookWriteError(w, r, err)
+		return
+	}
+	writeBook(w, r, http.StatusOK, book)
 }
-func createBook(w http.ResponseWriter, r *http.Request){
-	w.Header().Set("Content-Type", "application/json")
+
+func deleteBook(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	version, ok := checkIfMatch(w, r, params["id"])
+	if !ok {
+		return
+	}
+	if err := store.Delete(params["id"], version, actor(r)); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readBook decodes and validates a Book from the request body and resolves
+// its author. If the body is unusable it has already written the response.
+func readBook(w http.ResponseWriter, r *http.Request) (Book, bool) {
 	var book Book
-	_ = json.NewDecoder(r.Body).Decode(&book)
-	book.ID = strconv.Itoa(rand.Intn(10000000)) // Mock ID. not safe to use in prod (may not be unique)
-	books = append(books, book)
-	json.NewEncoder(w).Encode(book)
+	if err := json.NewDecoder(r.Body).Decode(&book); err != nil {
+		badBody(w, r, "a valid book", err)
+		return Book{}, false
+	}
+	if err := book.Validate(); err != nil {
+		writeInvalid(w, r, "book", err.(ValidationErrors))
+		return Book{}, false
+	}
+	if err := resolveAuthor(&book); err != nil {
+		bookWriteError(w, r, err)
+		return Book{}, false
+	}
+	return book, true
 }
-func updateBook(w http.ResponseWriter, r *http.Request){
-	w.Header().Set("Content-Type", "application/json")
-	params := mux.Vars(r)
-	for index, item := range books {
-		if item.ID == params["id"]{
-			books = append(books[:index], books[index + 1:]... )
-			var book Book
-			_ = json.NewDecoder(r.Body).Decode(&book)
-			book.ID = strconv.Itoa(rand.Intn(10000000)) // Mock ID. not safe to use in prod (may not be unique)
-			books = append(books, book)
-			json.NewEncoder(w).Encode(book)
-			return
+
+// bookWriteError is storeError for creating or changing a book, where an
+// unknown author is a mistake in the request body rather than in the URL
+func bookWriteError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrAuthorNotFound) {
+		writeInvalid(w, r, "book", ValidationErrors{{Field: "author_id", Message: "no author has this id"}})
+		return
+	}
+	storeError(w, r, err)
+}
+
+// storeError turns an error from the store into a response: a missing book
+// or author, or a failed version check, is the client's problem; anything
+// else is ours and gets logged
+func storeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrBookDeleted):
+		writeProblem(w, r, http.StatusGone, "book "+mux.Vars(r)["id"]+" has been deleted; it can be undeleted until it is purged")
+		return
+	case errors.Is(err, ErrNotDeleted):
+		writeProblem(w, r, http.StatusConflict, "book "+mux.Vars(r)["id"]+" has not been deleted")
+		return
+	case errors.Is(err, ErrBookNotFound):
+		writeProblem(w, r, http.StatusNotFound, "no book with id "+mux.Vars(r)["id"])
+		return
+	case errors.Is(err, ErrAuthorNotFound):
+		writeProblem(w, r, http.StatusNotFound, "no author with id "+mux.Vars(r)["id"])
+		return
+	case errors.Is(err, ErrAuthorInUse):
+		writeProblem(w, r, http.StatusConflict, "the author still has books; delete or reassign them first")
+		return
+	case errors.Is(err, ErrVersionConflict):
+		// lost the race between checkIfMatch and the write
+		writeProblem(w, r, http.StatusPreconditionFailed, "the book has been changed since you fetched it")
+		return
+	}
+	log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	writeProblem(w, r, http.StatusInternalServerError, "the book store failed, please try again later")
+}
+
+func main() {
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fresh, err := freshStore(cfg.store, cfg.dataFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err = openStore(cfg.store, cfg.dataFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fresh {
+		if err := seedSampleData(store); err != nil {
+			log.Fatal(err)
+		}
+	}
+	existing, err := store.List()
+	if err != nil {
+		log.Fatal(err)
+	}
+	authors, err := store.ListAuthors()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var taken []string
+	for _, b := range existing {
+		taken = append(taken, b.ID)
+	}
+	for _, a := range authors {
+		taken = append(taken, a.ID)
+	}
+	ids, err = newIDGenerator(cfg.ids, taken)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := adoptEmbeddedAuthors(); err != nil {
+		log.Fatal(err)
+	}
+
+	auth, err = newAuthenticator(cfg.jwtSecret, cfg.apiKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if auth.secret == nil && len(auth.apiKeys) == 0 {
+		log.Print("no JWT secret or API keys configured, the API is read-only")
+	}
+
+	readLimit, writeLimit = cfg.readLimit, cfg.writeLimit
+
+	if cfg.cacheTTL > 0 {
+		responses = newResponseCache(cfg.cacheTTL, cfg.cacheBytes)
+	}
+	// from here on every change to a book goes out to webhooks and event streams
+	store = wrapStore(store, responses)
+	clientMaxAge = cfg.cacheMaxAge
+	if cfg.idempotencyWindow > 0 {
+		idempotency = newIdempotencyKeys(cfg.idempotencyWindow)
+	}
+	hooks = newWebhooks(cfg.webhooks, cfg.webhookSecret)
+	streamFor = cfg.writeTimeout - cfg.writeTimeout/10
+	exportStall = cfg.writeTimeout
+
+	// SIGINT from the terminal, SIGTERM from whatever deploys us
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.retention > 0 {
+		go purgeTombstones(ctx, cfg.retention, cfg.purgeInterval)
+	}
+	go hooks.run(ctx)
+
+	ln, err := net.Listen("tcp", cfg.addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s", ln.Addr())
+
+	grpcDone := make(chan struct{})
+	if cfg.grpcAddr == "" {
+		close(grpcDone)
+	} else {
+		gln, err := net.Listen("tcp", cfg.grpcAddr)
+		if err != nil {
+			log.Fatal(err)
 		}
+		log.Printf("gRPC listening on %s", gln.Addr())
+		go func() {
+			if err := serveGRPC(ctx, newGRPCServer(), gln, cfg.shutdownTimeout); err != nil {
+				log.Fatal(err)
+			}
+			close(grpcDone)
+		}()
+	}
+
+	if err := serve(ctx, newServer(cfg, withMiddleware(newRouter(), cfg)), ln, cfg.shutdownTimeout); err != nil {
+		log.Fatal(err)
 	}
-	json.NewEncoder(w).Encode(books)
+	<-grpcDone
 }
-func deleteBook(w http.ResponseWriter, r *http.Request){
-	w.Header().Set("Content-Type", "application/json")
-	params := mux.Vars(r)
-	for index, item := range books {
-		if item.ID == params["id"]{
-			books = append(books[:index], books[index + 1:]... )
-			break
+
+// seedSampleData gives a brand new store a couple of books to play with
+func seedSampleData(s BookStore) error {
+	for _, a := range []Author{
+		{ID: "1", Firstname: "John", Lastname: "Smith"},
+		{ID: "2", Firstname: "Steve", Lastname: "Smith"},
+	} {
+		if _, err := s.CreateAuthor(a); err != nil {
+			return fmt.Errorf("adding sample author %s: %w", a.ID, err)
+		}
+	}
+	for _, b := range []Book{
+		{ID: "1", Isbn: "0306406152", Title: "Sample book", AuthorID: "1"},
+		{ID: "2", Isbn: "9783161484100", Title: "Sample book 2", AuthorID: "2"},
+	} {
+		if _, err := s.Create(b); err != nil {
+			return fmt.Errorf("adding sample book %s: %w", b.ID, err)
 		}
 	}
-	json.NewEncoder(w).Encode(books)
+	return nil
 }
 
-func main() {
+// newRouter wires up the book and author endpoints against the package-level store
+func newRouter() *mux.Router {
 	// init the router
 	r := mux.NewRouter()
+	r.Use(instrument)
+	r.NotFoundHandler = instrument(http.HandlerFunc(notFound))
+	r.MethodNotAllowedHandler = instrument(http.HandlerFunc(methodNotAllowed))
+
+	// every route gets its own per-client rate limit
+	read := func(h http.HandlerFunc) http.HandlerFunc { return rateLimited(readLimit, h) }
+	write := func(h http.HandlerFunc) http.HandlerFunc { return rateLimited(writeLimit, requireRole(roleEditor, h)) }
+
+	// create route handlers / enpdoints; reads are public, changes need an
+	// editor. They are served under every API version (see versions.go)
+	// and share their rate limits between them.
+	type route struct {
+		method, path string
+		as           func(apiVersion, http.HandlerFunc) http.HandlerFunc
+		h            http.HandlerFunc
+	}
+	books, plain := apiVersion.books, apiVersion.plain
+	routes := []route{
+		{"GET", "/books", books, read(getBooks)},
+		// before /books/{id}, which would take "search" or "events" for an ID
+		{"GET", "/books/search", books, read(searchBooks)},
+		{"GET", "/books/events", apiVersion.events, read(getBookEvents)},
+		{"GET", "/books/{id}", books, read(getBook)},
+		{"POST", "/books", books, write(idempotent(createBook))},
+		{"POST", "/books:import", plain, write(importBooks)},
+		{"GET", "/books:export", apiVersion.export, read(exportBooks)},
+		{"PUT", "/books/{id}", books, write(updateBook)},
+		{"PATCH", "/books/{id}", books, write(patchBook)},
+		{"DELETE", "/books/{id}", plain, write(deleteBook)},
+		{"POST", "/books/{id}:undelete", books, write(undeleteBook)},
+		{"GET", "/books/{id}/history", plain, read(getBookHistory)},
+
+		{"GET", "/authors", plain, read(getAuthors)},
+		{"GET", "/authors/{id}", plain, read(getAuthor)},
+		{"POST", "/authors", plain, write(createAuthor)},
+		{"PUT", "/authors/{id}", plain, write(updateAuthor)},
+		{"DELETE", "/authors/{id}", plain, write(deleteAuthor)},
+		{"GET", "/authors/{id}/books", books, read(getAuthorBooks)},
+	}
+	// book reads are answered from the response cache when they can be,
+	// which a write to what they depend on invalidates (see cache.go)
+	cacheTags := map[string]func(*http.Request) string{
+		"/books":        listTagOf,
+		"/books/search": listTagOf,
+		"/books/{id}":   bookTagOf,
+	}
+	for _, rt := range routes {
+		for _, v := range apiVersions {
+			h := rt.as(v, rt.h)
+			if tag, ok := cacheTags[rt.path]; ok && rt.method == "GET" {
+				h = cached(tag, h)
+			}
+			r.HandleFunc(v.prefix+rt.path, h).Methods(rt.method)
+		}
+	}
 
-	// Mock data @todo - implement dB
-	books = append(books, Book{ID: "1", Isbn: "4467899", Title: "Sample book", Author: &Author{Firstname: "John", Lastname: "Smith"}})
-	books = append(books, Book{ID: "2", Isbn: "4465589", Title: "Sample book 2", Author: &Author{Firstname: "Steve", Lastname: "Smith"}})
+	r.HandleFunc("/api/webhooks/dead-letters", read(requireRole(roleEditor, getDeadLetters))).Methods("GET")
 
-	// create route handlers / enpdoints
-	r.HandleFunc("/api/books", getBooks).Methods("GET")
-	r.HandleFunc("/api/books/{id}", getBook).Methods("GET")
-	r.HandleFunc("/api/books", createBook).Methods("POST")
-	r.HandleFunc("/api/books/{id}", updateBook).Methods("PUT")
-	r.HandleFunc("/api/books/{id}", deleteBook).Methods("DELETE")
-	
-	log.Fatal(http.ListenAndServe(":8000", r))
+	// queries are reads and mutations are writes, whichever method they use
+	r.HandleFunc("/graphql", routeGraphQL(read(serveGraphQL), write(serveGraphQL))).Methods("GET", "POST")
 
+	r.HandleFunc("/openapi.json", read(getOpenAPI)).Methods("GET")
 
-}
\ No newline at end of file
+	// for monitoring, so neither rate limited nor behind auth
+	r.HandleFunc("/metrics", getMetrics).Methods("GET")
+	r.HandleFunc("/healthz", getHealthz).Methods("GET")
+	r.HandleFunc("/readyz", getReadyz).Methods("GET")
+	return r
+}
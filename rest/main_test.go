@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testAPIKey belongs to an editor; requests built by editorRequest carry it
+const testAPIKey = "test-editor-key"
+
+func init() {
+	auth, _ = newAuthenticator("", "tests:"+testAPIKey+":editor")
+}
+
+// editorRequest builds a request made with an editor's credentials
+func editorRequest(method, path, body string) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("X-API-Key", testAPIKey)
+	return req
+}
+
+// do sends a request as an editor straight to the router and returns the
+// recorded response
+func do(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := editorRequest(method, path, body)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// useStore points the handlers at a fresh memory store holding books. Their
+// embedded authors are stored as authors of their own, as a POST would.
+func useStore(t *testing.T, books ...Book) {
+	t.Helper()
+	store = newMemoryStore()
+	for _, b := range books {
+		if err := resolveAuthor(&b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Create(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// storedBook fetches a book from the store with its author filled in
+func storedBook(t *testing.T, id string) Book {
+	t.Helper()
+	book, err := store.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expanded, err := withAuthors([]Book{book})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expanded[0]
+}
+
+func TestConcurrentCreateUpdateDelete(t *testing.T) {
+	store = newMemoryStore()
+	router := newRouter()
+
+	const workers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var created Book
+			rec := do(t, router, "POST", "/api/books", `{"title":"draft","author":{"lastname":"Smith"}}`)
+			if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+				t.Error(err)
+				return
+			}
+			var updated Book
+			rec = do(t, router, "PUT", "/api/books/"+created.ID, `{"title":"final","author":{"lastname":"Smith"}}`)
+			if err := json.NewDecoder(rec.Body).Decode(&updated); err != nil {
+				t.Error(err)
+				return
+			}
+			do(t, router, "GET", "/api/books", "")
+			do(t, router, "GET", "/api/books/"+updated.ID, "")
+			do(t, router, "DELETE", "/api/books/"+updated.ID, "")
+		}()
+	}
+	wg.Wait()
+
+	books, _ := store.List()
+	if len(books) != 0 {
+		t.Fatalf("%d books left after deleting everything: %+v", len(books), books)
+	}
+}
+
+func TestUpdateBookKeepsPathID(t *testing.T) {
+	useStore(t, Book{ID: "42", Title: "Old title", Author: &Author{Lastname: "Smith"}})
+
+	rec := do(t, newRouter(), "PUT", "/api/books/42", `{"id":"99","title":"New title","author":{"lastname":"Smith"}}`)
+
+	var got Book
+	json.NewDecoder(rec.Body).Decode(&got)
+	if got.ID != "42" || got.Title != "New title" {
+		t.Fatalf("PUT /api/books/42 returned %+v, want ID 42 with the new title", got)
+	}
+	if _, err := store.Get("42"); err != nil {
+		t.Errorf(`store.Get("42") after PUT: %v`, err)
+	}
+}
+
+func TestInsertBookRetriesTakenIDs(t *testing.T) {
+	useStore(t, Book{ID: "1"}, Book{ID: "2"})
+	ids = &sequenceGenerator{}
+	defer func() { ids = uuidGenerator{} }()
+
+	book, err := insertBook(Book{Title: "Third"})
+	if err != nil || book.ID != "3" {
+		t.Fatalf("insertBook() = %+v, %v, want ID 3", book, err)
+	}
+}
+
+func TestBookEndpointStatusCodes(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		wantStatus  int
+		wantContent string
+	}{
+		{"list", "GET", "/api/books", "", http.StatusOK, "application/json"},
+		{"get existing", "GET", "/api/books/1", "", http.StatusOK, "application/json"},
+		{"get missing", "GET", "/api/books/404", "", http.StatusNotFound, "application/problem+json"},
+		{"create", "POST", "/api/books", `{"title":"New","author":{"lastname":"Smith"}}`, http.StatusCreated, "application/json"},
+		{"create with broken json", "POST", "/api/books", `{"title":`, http.StatusBadRequest, "application/problem+json"},
+		{"create with empty body", "POST", "/api/books", "", http.StatusBadRequest, "application/problem+json"},
+		{"update existing", "PUT", "/api/books/1", `{"title":"Renamed","author":{"lastname":"Smith"}}`, http.StatusOK, "application/json"},
+		{"update missing", "PUT", "/api/books/404", `{"title":"Renamed","author":{"lastname":"Smith"}}`, http.StatusNotFound, "application/problem+json"},
+		{"create invalid book", "POST", "/api/books", `{"isbn":"123"}`, http.StatusUnprocessableEntity, "application/problem+json"},
+		{"update invalid book", "PUT", "/api/books/1", `{"title":""}`, http.StatusUnprocessableEntity, "application/problem+json"},
+		{"update with broken json", "PUT", "/api/books/1", `[1,2]`, http.StatusBadRequest, "application/problem+json"},
+		{"delete existing", "DELETE", "/api/books/1", "", http.StatusNoContent, ""},
+		{"delete missing", "DELETE", "/api/books/404", "", http.StatusNotFound, "application/problem+json"},
+		{"unknown route", "GET", "/api/nope", "", http.StatusNotFound, "application/problem+json"},
+		{"unsupported method", "PATCH", "/api/books", "", http.StatusMethodNotAllowed, "application/problem+json"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Lastname: "Smith"}})
+
+			rec := do(t, newRouter(), tc.method, tc.path, tc.body)
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("%s %s = %d, want %d (body %s)", tc.method, tc.path, rec.Code, tc.wantStatus, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tc.wantContent {
+				t.Errorf("Content-Type = %q, want %q", got, tc.wantContent)
+			}
+			if tc.wantContent == "application/problem+json" {
+				var p problem
+				if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+					t.Fatal(err)
+				}
+				if p.Status != tc.wantStatus || p.Title == "" || p.Instance != tc.path {
+					t.Errorf("problem = %+v, want status %d, a title and instance %s", p, tc.wantStatus, tc.path)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateBookSetsLocation(t *testing.T) {
+	store = newMemoryStore()
+
+	rec := do(t, newRouter(), "POST", "/api/books", `{"title":"New","author":{"lastname":"Smith"}}`)
+
+	var created Book
+	json.NewDecoder(rec.Body).Decode(&created)
+	if want := "/api/books/" + created.ID; rec.Header().Get("Location") != want {
+		t.Errorf("Location = %q, want %q", rec.Header().Get("Location"), want)
+	}
+}
+
+func TestCreateBookReportsFieldErrors(t *testing.T) {
+	store = newMemoryStore()
+
+	rec := do(t, newRouter(), "POST", "/api/books", `{"title":"Go","isbn":"123","author":{"firstname":"Rob"}}`)
+
+	var p problem
+	json.NewDecoder(rec.Body).Decode(&p)
+	if rec.Code != http.StatusUnprocessableEntity || len(p.Errors) != 2 {
+		t.Fatalf("POST = %d %+v, want 422 with two field errors", rec.Code, p)
+	}
+	if p.Errors[0].Field != "isbn" || p.Errors[1].Field != "author.lastname" {
+		t.Errorf("field errors = %+v, want isbn and author.lastname", p.Errors)
+	}
+	if books, _ := store.List(); len(books) != 0 {
+		t.Errorf("invalid book was stored: %+v", books)
+	}
+}
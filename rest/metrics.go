@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A small implementation of the Prometheus text exposition format, enough
+// for counters and histograms with labels.
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+
+var (
+	requestsTotal = newMetricVec("http_requests_total", "counter",
+		"Requests handled, by method, route template and status code.", "method", "route", "code")
+	requestErrors = newMetricVec("http_request_errors_total", "counter",
+		"Requests answered with a 4xx or 5xx status, by method, route template and status code.", "method", "route", "code")
+	requestDuration = newHistogramVec("http_request_duration_seconds",
+		"Time taken to handle requests, by method and route template.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "method", "route")
+)
+
+// instrument records the metrics for every request. It runs as mux
+// middleware, after routing, so requests are labelled with the route
+// template (/api/books/{id}) rather than the raw path; requests that match
+// no route are labelled "unmatched".
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		code := strconv.Itoa(rec.status)
+		requestsTotal.add(1, r.Method, route, code)
+		if rec.status >= 400 {
+			requestErrors.add(1, r.Method, route, code)
+		}
+		requestDuration.observe(time.Since(start).Seconds(), r.Method, route)
+	})
+}
+
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	requestsTotal.write(w)
+	requestErrors.write(w)
+	requestDuration.write(w)
+	cacheLookups.write(w)
+	if responses != nil {
+		_, size := responses.size()
+		writeGauge(w, "books_response_cache_bytes", "Bytes of response bodies in the response cache.", size)
+	}
+
+	// the catalogue size is read at scrape time rather than tracked
+	books, err := store.List()
+	if err == nil {
+		writeGauge(w, "books_catalogue_books", "Books in the catalogue.", len(books))
+	}
+	authors, err := store.ListAuthors()
+	if err == nil {
+		writeGauge(w, "books_catalogue_authors", "Authors in the catalogue.", len(authors))
+	}
+}
+
+// metricVec is a counter or histogram with one series per set of label values
+type metricVec struct {
+	name    string
+	kind    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds, histograms only
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // counter value, or histogram sum
+	count       uint64   // histogram only
+	counts      []uint64 // per bucket, histogram only
+}
+
+func newMetricVec(name, kind, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, kind: kind, help: help, labels: labels, series: map[string]*series{}}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	m := newMetricVec(name, "histogram", help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+// get must be called with m.mu held
+func (m *metricVec) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metricVec) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+func (m *metricVec) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	s.value += v
+	s.count++
+	for i, upper := range m.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		labels := formatLabels(m.labels, s.labelValues)
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatFloat(s.value))
+			continue
+		}
+		le := func(bound string) string {
+			names := append(append([]string(nil), m.labels...), "le")
+			return formatLabels(names, append(append([]string(nil), s.labelValues...), bound))
+		}
+		for i, upper := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, le(formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, le("+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	useStore(t,
+		Book{ID: "1", Title: "Sample book", Author: &Author{Lastname: "Smith"}},
+		Book{ID: "2", Title: "Sample book 2", Author: &Author{Lastname: "Jones"}},
+	)
+	router := newRouter()
+	do(t, router, "GET", "/api/books/1", "")
+	do(t, router, "GET", "/api/books/2", "")
+	do(t, router, "GET", "/api/books/metrics-test-missing", "")
+	do(t, router, "GET", "/no/such/route", "")
+
+	rec := do(t, router, "GET", "/metrics", "")
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("GET /metrics = %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{
+		"# TYPE http_requests_total counter",
+		`http_requests_total{method="GET",route="/api/books/{id}",code="200"}`,
+		`http_request_errors_total{method="GET",route="/api/books/{id}",code="404"}`,
+		`http_requests_total{method="GET",route="unmatched",code="404"}`,
+		"# TYPE http_request_duration_seconds histogram",
+		`http_request_duration_seconds_bucket{method="GET",route="/api/books/{id}",le="+Inf"}`,
+		`http_request_duration_seconds_count{method="GET",route="/api/books/{id}"}`,
+		"books_catalogue_books 2\n",
+		"books_catalogue_authors 2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics is missing %s", want)
+		}
+	}
+	if strings.Contains(body, "/api/books/1") {
+		t.Error("/metrics has raw paths, want route templates only")
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test.", []float64{0.1, 1}, "op")
+	h.observe(0.05, "a")
+	h.observe(0.5, "a")
+	h.observe(5, "a")
+
+	var b strings.Builder
+	h.write(&b)
+	for _, want := range []string{
+		`test_seconds_bucket{op="a",le="0.1"} 1`,
+		`test_seconds_bucket{op="a",le="1"} 2`,
+		`test_seconds_bucket{op="a",le="+Inf"} 3`,
+		`test_seconds_sum{op="a"} 5.55`,
+		`test_seconds_count{op="a"} 3`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("histogram output is missing %s:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := newFileStore(filepath.Join(dir, "data", "books.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = fs
+	router := newRouter()
+
+	if rec := do(t, router, "GET", "/healthz", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /healthz = %d, want 200", rec.Code)
+	}
+	// the data directory doesn't exist, so nothing could be saved
+	if rec := do(t, router, "GET", "/readyz", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz without a data directory = %d, want 503", rec.Code)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(t, router, "GET", "/readyz", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /readyz = %d, want 200", rec.Code)
+	}
+
+	useStore(t)
+	if rec := do(t, router, "GET", "/readyz", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /readyz with the memory store = %d, want 200", rec.Code)
+	}
+}
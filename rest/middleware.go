@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// middleware wraps a handler with behaviour shared by every request
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in mws; the first one listed sees the request first
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// withMiddleware puts the stack every request goes through around the router.
+// It wraps the router rather than using mux's Use so that 404s, 405s and CORS
+// preflights, which match no route, are logged and handled too.
+func withMiddleware(h http.Handler, cfg config) http.Handler {
+	return chain(h,
+		requestID,
+		accessLog(accessLogger),
+		recoverPanics,
+		cors(cfg.corsOrigins),
+		limitBody(cfg.maxBody),
+	)
+}
+
+// statusRecorder remembers what a handler wrote, for logging
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+type requestIDKey struct{}
+
+// requestID gives every request an ID, reusing the caller's X-Request-ID so
+// one ID can be followed across services. The ID is sent back in the
+// response and is available to handlers through requestIDFrom.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = uuidGenerator{}.NewID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID keeps caller-supplied IDs short and printable, since they
+// end up in our logs and response headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// accessLogger gets one JSON object per request
+var accessLogger = log.New(os.Stdout, "", 0)
+
+type accessEntry struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int     `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	Remote     string  `json:"remote"`
+}
+
+// accessLog writes a structured line for every request once it's done
+func accessLog(logger *log.Logger) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK // handler wrote nothing at all
+			}
+			line, _ := json.Marshal(accessEntry{
+				Time:       start.UTC().Format(time.RFC3339Nano),
+				RequestID:  requestIDFrom(r.Context()),
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Status:     rec.status,
+				Bytes:      rec.bytes,
+				DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+				Remote:     r.RemoteAddr,
+			})
+			logger.Print(string(line))
+		})
+	}
+}
+
+// recoverPanics turns a panicking handler into a logged 500 instead of a
+// dropped connection
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v) // the handler asked for the connection to be cut
+			}
+			log.Printf("panic serving %s %s (request %s): %v\n%s",
+				r.Method, r.URL.Path, requestIDFrom(r.Context()), v, debug.Stack())
+			if rec.status == 0 {
+				writeProblem(rec, r, http.StatusInternalServerError, "something went wrong, please try again later")
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+var (
+	corsMethods = "GET, POST, PUT, PATCH, DELETE"
+	corsHeaders = "Authorization, Content-Type, If-Match, If-None-Match, X-API-Key, X-Request-ID, Last-Event-ID, Idempotency-Key"
+	corsExpose  = "ETag, Location, Link, X-Total-Count, X-Request-ID, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, Content-Disposition, Idempotent-Replayed"
+)
+
+// cors lets browser clients served from the allowed origins call the API.
+// "*" allows any origin; with no origins configured CORS stays off.
+// Preflight requests are answered here and never reach the router.
+func cors(origins []string) middleware {
+	allowed := map[string]bool{}
+	for _, o := range origins {
+		allowed[strings.TrimRight(o, "/")] = true
+	}
+	return func(next http.Handler) http.Handler {
+		if len(allowed) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			w.Header().Add("Vary", "Origin")
+			if origin == "" || !(allowed["*"] || allowed[origin]) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Expose-Headers", corsExpose)
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Set("Access-Control-Allow-Methods", corsMethods)
+				h.Set("Access-Control-Allow-Headers", corsHeaders)
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int((10 * time.Minute).Seconds())))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if seen != "abc-123" || rec.Header().Get("X-Request-ID") != "abc-123" {
+		t.Errorf("caller's ID: handler saw %q, response has %q, want abc-123 for both", seen, rec.Header().Get("X-Request-ID"))
+	}
+
+	for _, incoming := range []string{"", "has spaces", strings.Repeat("x", 129)} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", incoming)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if seen == "" || seen == incoming || rec.Header().Get("X-Request-ID") != seen {
+			t.Errorf("incoming ID %q: handler saw %q, response has %q, want a fresh ID in both", incoming, seen, rec.Header().Get("X-Request-ID"))
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	h := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}), requestID, accessLog(log.New(&buf, "", 0)))
+
+	req := httptest.NewRequest("POST", "/api/books?x=1", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry accessEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+	}
+	if entry.Method != "POST" || entry.Path != "/api/books" || entry.Status != http.StatusTeapot ||
+		entry.Bytes != 15 || entry.RequestID != "req-1" || entry.Time == "" {
+		t.Errorf("log entry = %+v", entry)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	out := log.Writer()
+	log.SetOutput(&bytes.Buffer{}) // keep the stack trace out of the test output
+	defer log.SetOutput(out)
+
+	h := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/books", nil))
+
+	var p problem
+	json.NewDecoder(rec.Body).Decode(&p)
+	if rec.Code != http.StatusInternalServerError || p.Status != http.StatusInternalServerError ||
+		rec.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("after a panic got %d %q %+v, want a 500 problem", rec.Code, rec.Header().Get("Content-Type"), p)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	useStore(t)
+	h := withMiddleware(newRouter(), config{corsOrigins: []string{"https://books.example"}})
+	out := accessLogger.Writer()
+	accessLogger.SetOutput(&bytes.Buffer{})
+	defer accessLogger.SetOutput(out)
+
+	preflight := httptest.NewRequest("OPTIONS", "/api/books/1", nil)
+	preflight.Header.Set("Origin", "https://books.example")
+	preflight.Header.Set("Access-Control-Request-Method", "PUT")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, preflight)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://books.example" ||
+		!strings.Contains(rec.Header().Get("Access-Control-Allow-Methods"), "PUT") {
+		t.Errorf("preflight = %d %v", rec.Code, rec.Header())
+	}
+
+	// a browser retrying a create safely
+	preflight = httptest.NewRequest("OPTIONS", "/api/books", nil)
+	preflight.Header.Set("Origin", "https://books.example")
+	preflight.Header.Set("Access-Control-Request-Method", "POST")
+	preflight.Header.Set("Access-Control-Request-Headers", "content-type, idempotency-key, x-api-key")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, preflight)
+	if !strings.Contains(rec.Header().Get("Access-Control-Allow-Headers"), "Idempotency-Key") ||
+		!strings.Contains(rec.Header().Get("Access-Control-Expose-Headers"), "Idempotent-Replayed") {
+		t.Errorf("preflight for an idempotent POST = %v, want Idempotency-Key allowed and Idempotent-Replayed exposed", rec.Header())
+	}
+
+	req := httptest.NewRequest("GET", "/api/books", nil)
+	req.Header.Set("Origin", "https://books.example")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "https://books.example" ||
+		!strings.Contains(rec.Header().Get("Access-Control-Expose-Headers"), "ETag") {
+		t.Errorf("simple request = %d %v", rec.Code, rec.Header())
+	}
+
+	req = httptest.NewRequest("GET", "/api/books", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin was allowed: %v", rec.Header())
+	}
+}
@@ -0,0 +1,23 @@
+// Package model holds the books API's resources as they go over the wire,
+// shared by the server and the client.
+package model
+
+import "time"
+
+type Book struct {
+	ID       string  `json:"id" xml:"id"`
+	Isbn     string  `json:"isbn" xml:"isbn"`
+	Title    string  `json:"title" xml:"title"`
+	AuthorID string  `json:"author_id" xml:"author_id"`
+	Author   *Author `json:"author,omitempty" xml:"author,omitempty"` // only filled in for ?expand=author
+	Version  int     `json:"version" xml:"version"`                   // set by the store, sent as the ETag
+
+	UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`                     // set by the store
+	UpdatedBy string    `json:"updated_by,omitempty" xml:"updated_by,omitempty"` // whoever made the last change
+}
+
+type Author struct {
+	ID        string `json:"id" xml:"id"`
+	Firstname string `json:"firstname" xml:"firstname"`
+	Lastname  string `json:"lastname" xml:"lastname"`
+}
@@ -0,0 +1,126 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxTitleLength = 200
+	maxNameLength  = 80
+)
+
+// FieldError describes one invalid field of a request body
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is every FieldError found in one value
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, fe := range v {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (v *ValidationErrors) add(field, format string, args ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns nil rather than an empty, non-nil ValidationErrors
+func (v ValidationErrors) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+func (author *Author) Validate() error {
+	return author.validate("").err()
+}
+
+// validate prefixes field names so errors nested in a Book read "author.lastname"
+func (author *Author) validate(prefix string) ValidationErrors {
+	var errs ValidationErrors
+	if utf8.RuneCountInString(author.Firstname) > maxNameLength {
+		errs.add(prefix+"firstname", "must be at most %d characters", maxNameLength)
+	}
+	if strings.TrimSpace(author.Lastname) == "" {
+		errs.add(prefix+"lastname", "is required")
+	} else if utf8.RuneCountInString(author.Lastname) > maxNameLength {
+		errs.add(prefix+"lastname", "must be at most %d characters", maxNameLength)
+	}
+	return errs
+}
+
+func (book *Book) Validate() error {
+	var errs ValidationErrors
+	if strings.TrimSpace(book.Title) == "" {
+		errs.add("title", "is required")
+	} else if utf8.RuneCountInString(book.Title) > maxTitleLength {
+		errs.add("title", "must be at most %d characters", maxTitleLength)
+	}
+	if book.Isbn != "" && !ValidISBN(book.Isbn) {
+		errs.add("isbn", "is not a valid ISBN-10 or ISBN-13")
+	}
+	// a book names its author by author_id, or embeds one as older
+	// clients do; an embedded author is ignored when author_id is set
+	if book.AuthorID == "" {
+		if book.Author == nil {
+			errs.add("author", "is required: set author_id or embed an author")
+		} else {
+			errs = append(errs, book.Author.validate("author.")...)
+		}
+	}
+	return errs.err()
+}
+
+// NormalizeISBN drops the hyphens and spaces people write between the digits
+func NormalizeISBN(isbn string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(isbn)
+}
+
+// ValidISBN checks the length and check digit of an ISBN-10 or ISBN-13.
+// Hyphens and spaces between the digits are ignored.
+func ValidISBN(isbn string) bool {
+	digits := NormalizeISBN(isbn)
+	switch len(digits) {
+	case 10:
+		// weights 10..1, the last digit may be X (10)
+		sum := 0
+		for i, c := range digits {
+			var d int
+			switch {
+			case c >= '0' && c <= '9':
+				d = int(c - '0')
+			case (c == 'X' || c == 'x') && i == 9:
+				d = 10
+			default:
+				return false
+			}
+			sum += d * (10 - i)
+		}
+		return sum%11 == 0
+	case 13:
+		// alternating weights 1 and 3
+		sum := 0
+		for i, c := range digits {
+			if c < '0' || c > '9' {
+				return false
+			}
+			d := int(c - '0')
+			if i%2 == 1 {
+				d *= 3
+			}
+			sum += d
+		}
+		return sum%10 == 0
+	default:
+		return false
+	}
+}
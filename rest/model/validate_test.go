@@ -0,0 +1,70 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidISBN(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want bool
+	}{
+		{"0306406152", true},
+		{"0-306-40615-2", true},
+		{"080442957X", true},
+		{"0306406153", false},
+		{"9783161484100", true},
+		{"978-3-16-148410-0", true},
+		{"9783161484101", false},
+		{"X306406152", false},
+		{"4467899", false},
+		{"not an isbn", false},
+	}
+	for _, tc := range tests {
+		if got := ValidISBN(tc.isbn); got != tc.want {
+			t.Errorf("ValidISBN(%q) = %v, want %v", tc.isbn, got, tc.want)
+		}
+	}
+}
+
+func TestBookValidation(t *testing.T) {
+	author := &Author{Firstname: "John", Lastname: "Smith"}
+	tests := []struct {
+		name       string
+		book       Book
+		wantFields []string
+	}{
+		{"valid", Book{Title: "Go", Isbn: "0306406152", Author: author}, nil},
+		{"isbn is optional", Book{Title: "Go", Author: author}, nil},
+		{"empty", Book{}, []string{"title", "author"}},
+		{"blank title", Book{Title: "  ", Author: author}, []string{"title"}},
+		{"long title", Book{Title: strings.Repeat("a", 201), Author: author}, []string{"title"}},
+		{"bad isbn", Book{Title: "Go", Isbn: "12345", Author: author}, []string{"isbn"}},
+		{"author without lastname", Book{Title: "Go", Author: &Author{Firstname: "John"}}, []string{"author.lastname"}},
+		{"long author names", Book{Title: "Go", Author: &Author{Firstname: strings.Repeat("a", 81), Lastname: strings.Repeat("b", 81)}}, []string{"author.firstname", "author.lastname"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.book.Validate()
+			if tc.wantFields == nil {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			var errs ValidationErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("Validate() = %v, want ValidationErrors", err)
+			}
+			var fields []string
+			for _, fe := range errs {
+				fields = append(fields, fe.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tc.wantFields, ",") {
+				t.Errorf("invalid fields = %v, want %v", fields, tc.wantFields)
+			}
+		})
+	}
+}
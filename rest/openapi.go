@@ -0,0 +1,368 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// obj is a JSON object in the OpenAPI document
+type obj = map[string]interface{}
+
+// schemas are the named types in components/schemas. Their schemas come
+// from the structs' JSON tags, so they can't drift from what we encode.
+var schemas = map[string]reflect.Type{
+	"Book":       reflect.TypeOf(Book{}),
+	"Author":     reflect.TypeOf(Author{}),
+	"Problem":    reflect.TypeOf(problem{}),
+	"FieldError": reflect.TypeOf(FieldError{}),
+	"Change":     reflect.TypeOf(Change{}),
+	"Event":      reflect.TypeOf(Event{}),
+	"FieldDiff":  reflect.TypeOf(FieldDiff{}),
+
+	"BookV2":         reflect.TypeOf(bookV2{}),
+	"ImportReport":   reflect.TypeOf(importReport{}),
+	"GraphQLRequest": reflect.TypeOf(graphqlRequest{}),
+}
+
+// operation describes one route for the OpenAPI document
+type operation struct {
+	method  string
+	path    string
+	id      string
+	summary string
+	params  []obj
+	body    obj         // request body content, nil if none
+	status  int         // success status
+	result  interface{} // success schema, nil for no body
+	content []string    // success media types, application/json if none
+	headers []string    // response headers sent on success
+	errors  []int       // error statuses, answered with a Problem
+	editor  bool        // needs credentials with the editor role
+	free    bool        // not rate limited
+
+	deprecated bool
+}
+
+var (
+	idParam     = obj{"name": "id", "in": "path", "required": true, "schema": obj{"type": "string"}}
+	expandParam = queryParam("expand", "set to author to embed each book's author", obj{"type": "string", "enum": []string{"author"}})
+	ifMatch     = obj{"name": "If-Match", "in": "header", "description": "only change the book if its ETag still matches", "schema": obj{"type": "string"}}
+	ifNoneMatch = obj{"name": "If-None-Match", "in": "header", "description": "answer 304 if the book's ETag matches", "schema": obj{"type": "string"}}
+	idemKey     = obj{"name": "Idempotency-Key", "in": "header", "description": "a unique key for the request; repeats with the same key and body are answered with the first response", "schema": obj{"type": "string", "maxLength": maxIdempotencyKey}}
+	listParams  = []obj{
+		queryParam("limit", "page size", obj{"type": "integer", "minimum": 1, "maximum": maxPageSize, "default": defaultPageSize}),
+		queryParam("offset", "number of books to skip", obj{"type": "integer", "minimum": 0, "default": 0}),
+		queryParam("author", "author last name, case-insensitive", obj{"type": "string"}),
+		queryParam("title", "substring of the title, case-insensitive", obj{"type": "string"}),
+		queryParam("isbn", "exact ISBN, hyphens ignored", obj{"type": "string"}),
+		queryParam("sort", "id, title or isbn; prefix with - for descending", obj{"type": "string", "enum": []string{"id", "-id", "title", "-title", "isbn", "-isbn"}}),
+		expandParam,
+	}
+	bookBody      = obj{"application/json": obj{"schema": ref("Book")}}
+	authorBody    = obj{"application/json": obj{"schema": ref("Author")}}
+	patchBody     = obj{mergePatchType: obj{"schema": obj{"type": "object", "description": "RFC 7396 JSON Merge Patch against the book"}}}
+	bookList      = obj{"type": "array", "items": ref("Book")}
+	graphqlResult = obj{"type": "object", "description": "data, and errors[] if any part of the request failed",
+		"properties": obj{"data": obj{"type": "object"}, "errors": obj{"type": "array", "items": obj{"type": "object"}}}}
+	importBody = obj{
+		csvType:    obj{"schema": obj{"type": "string", "description": "a header row naming the columns, then one book per row"}},
+		ndjsonType: obj{"schema": obj{"type": "string", "description": "one Book per line"}},
+	}
+)
+
+// operations lists every route newRouter registers; TestOpenAPICoversRoutes
+// fails when the two disagree
+var operations = []operation{
+	{method: "GET", path: "/api/books", id: "listBooks", summary: "List books",
+		params: listParams, status: 200, result: bookList, headers: []string{"X-Total-Count", "Link", "Cache-Control"}, errors: []int{400}},
+	{method: "GET", path: "/api/books/search", id: "searchBooks", summary: "Search books by title, author name or ISBN, best match first",
+		params: append([]obj{{"name": "q", "in": "query", "required": true, "description": "words to look for; each must match the start of a word in the book", "schema": obj{"type": "string"}}}, listParams...),
+		status: 200, result: bookList, headers: []string{"X-Total-Count", "Link", "Cache-Control"}, errors: []int{400}},
+	{method: "GET", path: "/api/books/events", id: "streamBookEvents", summary: "Server-Sent Events for every change to a book; reconnect with Last-Event-ID to catch up",
+		params: []obj{{"name": "Last-Event-ID", "in": "header", "description": "ID of the last event received", "schema": obj{"type": "string"}}},
+		status: 200, content: []string{"text/event-stream"}, result: ref("Event")},
+	{method: "POST", path: "/api/books", id: "createBook", summary: "Create a book",
+		params: []obj{expandParam, idemKey}, body: bookBody, status: 201, result: ref("Book"), headers: []string{"Location", "ETag", "Idempotent-Replayed"}, errors: []int{400, 422}, editor: true},
+	{method: "POST", path: "/api/books:import", id: "importBooks", summary: "Create books from CSV or NDJSON, reporting on each row",
+		body: importBody, status: 200, result: ref("ImportReport"), errors: []int{400, 415}, editor: true},
+	{method: "GET", path: "/api/books:export", id: "exportBooks", summary: "Download every book as CSV or NDJSON",
+		params: []obj{queryParam("format", "csv or ndjson", obj{"type": "string", "enum": []string{"csv", "ndjson"}, "default": "csv"})},
+		status: 200, content: []string{csvType, ndjsonType}, result: obj{"type": "string"}, headers: []string{"Content-Disposition"}, errors: []int{400}},
+	{method: "GET", path: "/api/books/{id}", id: "getBook", summary: "Get a book",
+		params: []obj{idParam, expandParam, ifNoneMatch}, status: 200, result: ref("Book"), headers: []string{"ETag", "Cache-Control"}, errors: []int{404, 410}},
+	{method: "PUT", path: "/api/books/{id}", id: "updateBook", summary: "Replace a book",
+		params: []obj{idParam, expandParam, ifMatch}, body: bookBody, status: 200, result: ref("Book"), headers: []string{"ETag"}, errors: []int{400, 404, 410, 412, 422}, editor: true},
+	{method: "PATCH", path: "/api/books/{id}", id: "patchBook", summary: "Change part of a book",
+		params: []obj{idParam, expandParam, ifMatch}, body: patchBody, status: 200, result: ref("Book"), headers: []string{"ETag"}, errors: []int{400, 404, 409, 410, 412, 415, 422}, editor: true},
+	{method: "DELETE", path: "/api/books/{id}", id: "deleteBook", summary: "Delete a book",
+		params: []obj{idParam, ifMatch}, status: 204, errors: []int{404, 410, 412}, editor: true},
+
+	{method: "POST", path: "/api/books/{id}:undelete", id: "undeleteBook", summary: "Bring back a deleted book that hasn't been purged",
+		params: []obj{idParam, expandParam}, status: 200, result: ref("Book"), headers: []string{"ETag"}, errors: []int{404, 409}, editor: true},
+	{method: "GET", path: "/api/books/{id}/history", id: "getBookHistory", summary: "Who changed a book, when, and what changed, oldest first",
+		params: []obj{idParam}, status: 200, result: obj{"type": "array", "items": ref("Change")}, errors: []int{404}},
+
+	{method: "GET", path: "/api/authors", id: "listAuthors", summary: "List authors",
+		status: 200, result: obj{"type": "array", "items": ref("Author")}},
+	{method: "POST", path: "/api/authors", id: "createAuthor", summary: "Create an author",
+		body: authorBody, status: 201, result: ref("Author"), headers: []string{"Location"}, errors: []int{400, 422}, editor: true},
+	{method: "GET", path: "/api/authors/{id}", id: "getAuthor", summary: "Get an author",
+		params: []obj{idParam}, status: 200, result: ref("Author"), errors: []int{404}},
+	{method: "PUT", path: "/api/authors/{id}", id: "updateAuthor", summary: "Replace an author",
+		params: []obj{idParam}, body: authorBody, status: 200, result: ref("Author"), errors: []int{400, 404, 422}, editor: true},
+	{method: "DELETE", path: "/api/authors/{id}", id: "deleteAuthor", summary: "Delete an author without books",
+		params: []obj{idParam}, status: 204, errors: []int{404, 409}, editor: true},
+	{method: "GET", path: "/api/authors/{id}/books", id: "listAuthorBooks", summary: "List an author's books",
+		params: append([]obj{idParam}, listParams...), status: 200, result: bookList, headers: []string{"X-Total-Count", "Link"}, errors: []int{400, 404}},
+
+	{method: "GET", path: "/api/webhooks/dead-letters", id: "listDeadLetters", summary: "Webhook deliveries that were given up on",
+		status: 200, result: obj{"type": "array", "items": schemaOf(reflect.TypeOf(deadLetter{}), true)}, editor: true},
+
+	{method: "GET", path: "/graphql", id: "queryGraphQL", summary: "Run a GraphQL query over books and authors; mutations must be POSTed",
+		params: []obj{
+			{"name": "query", "in": "query", "required": true, "description": "the GraphQL document", "schema": obj{"type": "string"}},
+			queryParam("variables", "variables as a JSON object", obj{"type": "string"}),
+			queryParam("operationName", "which operation in the document to run", obj{"type": "string"}),
+		},
+		status: 200, result: graphqlResult, errors: []int{400, 405}},
+	{method: "POST", path: "/graphql", id: "postGraphQL", summary: "Run a GraphQL query or mutation over books and authors; mutations need the editor role",
+		body:   obj{"application/json": obj{"schema": ref("GraphQLRequest")}, "application/graphql": obj{"schema": obj{"type": "string"}}},
+		status: 200, result: graphqlResult, errors: []int{400, 401, 403}},
+
+	{method: "GET", path: "/openapi.json", id: "getOpenAPI", summary: "This document",
+		status: 200, result: obj{"type": "object"}},
+	{method: "GET", path: "/metrics", id: "getMetrics", summary: "Metrics in the Prometheus text format",
+		status: 200, content: []string{"text/plain"}, result: obj{"type": "string"}, free: true},
+	{method: "GET", path: "/healthz", id: "getHealthz", summary: "Liveness check",
+		status: 200, result: obj{"type": "object"}, free: true},
+	{method: "GET", path: "/readyz", id: "getReadyz", summary: "Readiness check: is the book store reachable",
+		status: 200, result: obj{"type": "object"}, errors: []int{503}, free: true},
+}
+
+func getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPISpec())
+}
+
+// openAPISpec builds the OpenAPI 3 document for the books API
+func openAPISpec() obj {
+	paths := obj{}
+	for _, unversioned := range operations {
+		for _, op := range unversioned.inVersions() {
+			item, ok := paths[op.path].(obj)
+			if !ok {
+				item = obj{}
+				paths[op.path] = item
+			}
+			item[strings.ToLower(op.method)] = op.spec()
+		}
+	}
+
+	components := obj{}
+	for name, t := range schemas {
+		components[name] = schemaOf(t, true)
+	}
+	return obj{
+		"openapi": "3.0.3",
+		"info": obj{
+			"title":   "Books API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": obj{
+			"schemas": components,
+			"securitySchemes": obj{
+				"bearerAuth": obj{"type": "http", "scheme": "bearer", "bearerFormat": "JWT",
+					"description": "HS256 token with an exp claim and the editor role in its roles claim"},
+				"apiKey": obj{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+// inVersions is the operation as it is served under each API version, if
+// it is one of the book or author routes; the operations table lists them
+// under the bare /api. Under v2 books are BookV2s, and book responses can
+// be had in any of bookTypes.
+func (op operation) inVersions() []operation {
+	if !strings.HasPrefix(op.path, "/api/books") && !strings.HasPrefix(op.path, "/api/authors") {
+		return []operation{op}
+	}
+	var ops []operation
+	for _, v := range apiVersions {
+		vop := op
+		vop.path = v.prefix + strings.TrimPrefix(op.path, "/api")
+		vop.errors = append(append([]int{}, op.errors...), http.StatusNotAcceptable)
+		if _, books := swapRef(op.result, "Book", "Book"); books {
+			vop.content = bookTypes
+		}
+		switch v.prefix {
+		case "/api":
+			vop.deprecated = true // use /api/v1
+		case "/api/v2":
+			vop.id += "V2"
+			vop.result, _ = swapRef(op.result, "Book", "BookV2")
+			if op.body != nil {
+				body, _ := swapRef(op.body, "Book", "BookV2")
+				vop.body = body.(obj)
+			}
+		default:
+			vop.id += "V" + strconv.Itoa(v.number)
+		}
+		ops = append(ops, vop)
+	}
+	return ops
+}
+
+// swapRef copies schema with references to the from schema pointing at to
+// instead, and says whether there were any
+func swapRef(schema interface{}, from, to string) (interface{}, bool) {
+	switch s := schema.(type) {
+	case obj:
+		swapped, found := obj{}, false
+		for k, v := range s {
+			if k == "$ref" && v == ref(from)["$ref"] {
+				swapped[k], found = ref(to)["$ref"], true
+				continue
+			}
+			var f bool
+			swapped[k], f = swapRef(v, from, to)
+			found = found || f
+		}
+		return swapped, found
+	case []obj:
+		swapped, found := make([]obj, len(s)), false
+		for i, v := range s {
+			o, f := swapRef(v, from, to)
+			swapped[i], found = o.(obj), found || f
+		}
+		return swapped, found
+	}
+	return schema, false
+}
+
+func (op operation) spec() obj {
+	success := obj{"description": http.StatusText(op.status)}
+	if op.result != nil {
+		types := op.content
+		if len(types) == 0 {
+			types = []string{"application/json"}
+		}
+		content := obj{}
+		for _, t := range types {
+			content[t] = obj{"schema": op.result}
+		}
+		success["content"] = content
+	}
+	if len(op.headers) > 0 {
+		headers := obj{}
+		for _, h := range op.headers {
+			headers[h] = obj{"schema": obj{"type": "string"}}
+		}
+		success["headers"] = headers
+	}
+	responses := obj{strconv.Itoa(op.status): success}
+	if op.method == "GET" && hasParam(op.params, "If-None-Match") {
+		responses["304"] = obj{"description": http.StatusText(http.StatusNotModified)}
+	}
+	statuses := op.errors
+	if op.editor {
+		statuses = append(statuses, http.StatusUnauthorized, http.StatusForbidden)
+	}
+	if op.body != nil {
+		statuses = append(statuses, http.StatusRequestEntityTooLarge)
+	}
+	if !op.free {
+		statuses = append(statuses, http.StatusTooManyRequests)
+	}
+	// any route can fail on our side
+	for _, status := range append(statuses, http.StatusInternalServerError) {
+		responses[strconv.Itoa(status)] = obj{
+			"description": http.StatusText(status),
+			"content":     obj{"application/problem+json": obj{"schema": ref("Problem")}},
+		}
+	}
+
+	spec := obj{"operationId": op.id, "summary": op.summary, "responses": responses}
+	if len(op.params) > 0 {
+		spec["parameters"] = op.params
+	}
+	if op.body != nil {
+		spec["requestBody"] = obj{"required": true, "content": op.body}
+	}
+	if op.editor {
+		spec["security"] = []obj{{"bearerAuth": []string{}}, {"apiKey": []string{}}}
+	}
+	if op.deprecated {
+		spec["deprecated"] = true
+	}
+	return spec
+}
+
+// schemaOf describes t from its Go type and JSON tags. Named structs are
+// described in full only at the top level and referenced everywhere else.
+func schemaOf(t reflect.Type, top bool) obj {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), top)
+	case reflect.String:
+		return obj{"type": "string"}
+	case reflect.Bool:
+		return obj{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return obj{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return obj{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return obj{"type": "array", "items": schemaOf(t.Elem(), false)}
+	case reflect.Map:
+		return obj{"type": "object", "additionalProperties": schemaOf(t.Elem(), false)}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return obj{"type": "string", "format": "date-time"}
+		}
+		if !top && t.Name() != "" {
+			if _, ok := schemas[t.Name()]; ok {
+				return ref(t.Name())
+			}
+		}
+		props := obj{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // unexported
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = schemaOf(f.Type, false)
+		}
+		return obj{"type": "object", "properties": props}
+	default:
+		return obj{}
+	}
+}
+
+func ref(name string) obj {
+	return obj{"$ref": "#/components/schemas/" + name}
+}
+
+func queryParam(name, description string, schema obj) obj {
+	return obj{"name": name, "in": "query", "description": description, "schema": schema}
+}
+
+func hasParam(params []obj, name string) bool {
+	for _, p := range params {
+		if p["name"] == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestOpenAPICoversRoutes fails when a route is registered in newRouter but
+// missing from the document, or documented but not routed
+func TestOpenAPICoversRoutes(t *testing.T) {
+	useStore(t)
+	router := newRouter()
+
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	rec := do(t, router, "GET", "/openapi.json", "")
+	if err := json.NewDecoder(rec.Body).Decode(&spec); err != nil {
+		t.Fatalf("GET /openapi.json: %d %v", rec.Code, err)
+	}
+
+	routed := map[string]bool{}
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil // not a path route
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Errorf("route %s has no methods", path)
+			return nil
+		}
+		for _, m := range methods {
+			routed[m+" "+path] = true
+			if _, ok := spec.Paths[path][strings.ToLower(m)]; !ok {
+				t.Errorf("%s %s is routed but missing from /openapi.json", m, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, item := range spec.Paths {
+		for method := range item {
+			if !routed[strings.ToUpper(method)+" "+path] {
+				t.Errorf("%s %s is documented but not routed", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func TestOpenAPISchemasFollowJSONTags(t *testing.T) {
+	spec := openAPISpec()
+	book := spec["components"].(obj)["schemas"].(obj)["Book"].(obj)["properties"].(obj)
+	for _, field := range []string{"id", "isbn", "title", "author_id", "author", "version"} {
+		if _, ok := book[field]; !ok {
+			t.Errorf("Book schema has no %q property: %v", field, book)
+		}
+	}
+	if got := book["author"].(obj)["$ref"]; got != "#/components/schemas/Author" {
+		t.Errorf("Book.author = %v, want a reference to Author", got)
+	}
+	if got := book["version"].(obj)["type"]; got != "integer" {
+		t.Errorf("Book.version type = %v, want integer", got)
+	}
+
+	responses := spec["paths"].(obj)["/api/books/{id}"].(obj)["get"].(obj)["responses"].(obj)
+	for _, status := range []string{"200", "304", "404", "500"} {
+		if _, ok := responses[status]; !ok {
+			t.Errorf("GET /api/books/{id} does not document a %s response", status)
+		}
+	}
+	if _, err := json.Marshal(spec); err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(t, newRouter(), "GET", "/openapi.json", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /openapi.json = %d", rec.Code)
+	}
+}
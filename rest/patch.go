@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+const mergePatchType = "application/merge-patch+json"
+
+// patchBook applies an RFC 7396 JSON Merge Patch to a stored book, so a
+// client can change just the title or the author's last name:
+//
+//	PATCH /api/books/1
+//	Content-Type: application/merge-patch+json
+//
+//	{"author": {"lastname": "Jones"}}
+//
+// A null member removes the field. The result is validated like a PUT body.
+// If-Match is honoured as for PUT; without it the patch still only applies
+// to the version it was computed from, and a concurrent edit gives a 409.
+func patchBook(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchType && mediaType != "application/json" {
+		w.Header().Set("Accept-Patch", mergePatchType)
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "send the patch as "+mergePatchType)
+		return
+	}
+
+	params := mux.Vars(r)
+	book, err := store.Get(params["id"])
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !strongMatch(ifMatch, book) {
+		preconditionFailed(w, r, book)
+		return
+	}
+	version := book.Version
+
+	var patch interface{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		badBody(w, r, "valid JSON", err)
+		return
+	}
+
+	// patch the expanded form, so {"author": {"lastname": "Jones"}} works
+	expanded, err := withAuthors([]Book{book})
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	before := expanded[0]
+	book, err = applyMergePatch(before, patch)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "the patched document is not a book: "+err.Error())
+		return
+	}
+	book.ID = params["id"]
+	book.Version = version
+	book.UpdatedBy = actor(r)
+	if book.AuthorID != before.AuthorID || sameAuthor(book.Author, before.Author) {
+		// either the patch picked another author by id, or it didn't touch
+		// the author at all
+		book.Author = nil
+	} else {
+		// the embedded author was edited: that names a (maybe new) author
+		// by name, it doesn't rename the author other books share
+		book.AuthorID = ""
+	}
+	if err := book.Validate(); err != nil {
+		writeInvalid(w, r, "book", err.(ValidationErrors))
+		return
+	}
+	if err := resolveAuthor(&book); err != nil {
+		bookWriteError(w, r, err)
+		return
+	}
+	book, err = store.Update(book.ID, book)
+	if errors.Is(err, ErrVersionConflict) && ifMatch == "" {
+		writeProblem(w, r, http.StatusConflict, "the book changed while the patch was applied, please retry")
+		return
+	}
+	if err != nil {
+		bookWriteError(w, r, err)
+		return
+	}
+	writeBook(w, r, http.StatusOK, book)
+}
+
+func sameAuthor(a, b *Author) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// applyMergePatch round-trips book through its JSON form so the patch is
+// applied to exactly what clients see
+func applyMergePatch(book Book, patch interface{}) (Book, error) {
+	data, err := json.Marshal(book)
+	if err != nil {
+		return Book{}, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return Book{}, err
+	}
+	if data, err = json.Marshal(mergePatch(doc, patch)); err != nil {
+		return Book{}, err
+	}
+	var patched Book
+	err = json.Unmarshal(data, &patched)
+	return patched, err
+}
+
+// mergePatch is the MergePatch function from RFC 7396 section 2
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+		} else {
+			t[name] = mergePatch(t[name], value)
+		}
+	}
+	return t
+}
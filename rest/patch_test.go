@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// the test cases from RFC 7396 appendix A
+func TestMergePatch(t *testing.T) {
+	tests := []struct{ target, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tc := range tests {
+		var target, patch interface{}
+		json.Unmarshal([]byte(tc.target), &target)
+		json.Unmarshal([]byte(tc.patch), &patch)
+		got, _ := json.Marshal(mergePatch(target, patch))
+		if string(got) != tc.want {
+			t.Errorf("mergePatch(%s, %s) = %s, want %s", tc.target, tc.patch, got, tc.want)
+		}
+	}
+}
+
+func TestPatchBook(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantTitle   string
+		wantAuthor  string
+	}{
+		{"title only", mergePatchType, `{"title":"Renamed"}`, http.StatusOK, "Renamed", "Smith"},
+		{"author lastname only", mergePatchType, `{"author":{"lastname":"Jones"}}`, http.StatusOK, "Sample book", "Jones"},
+		{"plain json is accepted", "application/json", `{"title":"Renamed"}`, http.StatusOK, "Renamed", "Smith"},
+		{"id in body is ignored", mergePatchType, `{"id":"2"}`, http.StatusOK, "Sample book", "Smith"},
+		{"removing a required field", mergePatchType, `{"author":null}`, http.StatusUnprocessableEntity, "Sample book", "Smith"},
+		{"wrong type", mergePatchType, `{"title":7}`, http.StatusUnprocessableEntity, "Sample book", "Smith"},
+		{"broken json", mergePatchType, `{"title":`, http.StatusBadRequest, "Sample book", "Smith"},
+		{"json patch is not supported", "application/json-patch+json", `[]`, http.StatusUnsupportedMediaType, "Sample book", "Smith"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Firstname: "John", Lastname: "Smith"}})
+
+			req := editorRequest("PATCH", "/api/books/1", tc.body)
+			req.Header.Set("Content-Type", tc.contentType)
+			rec := httptest.NewRecorder()
+			newRouter().ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("PATCH = %d, want %d (body %s)", rec.Code, tc.wantStatus, rec.Body)
+			}
+			got := storedBook(t, "1")
+			if got.Title != tc.wantTitle || got.Author.Lastname != tc.wantAuthor || got.Author.Firstname != "John" {
+				t.Errorf("stored book = %+v %+v, want title %q by John %s", got, got.Author, tc.wantTitle, tc.wantAuthor)
+			}
+		})
+	}
+}
+
+func TestPatchBookNeedsContentType(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Lastname: "Smith"}})
+
+	rec := do(t, newRouter(), "PATCH", "/api/books/1", `{"title":"Renamed"}`)
+
+	if rec.Code != http.StatusUnsupportedMediaType || rec.Header().Get("Accept-Patch") != mergePatchType {
+		t.Errorf("PATCH without Content-Type = %d, Accept-Patch %q, want 415 and %s",
+			rec.Code, rec.Header().Get("Accept-Patch"), mergePatchType)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rest/model"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// listQuery is the filtering, sorting and paging asked for in the query
+// string of GET /api/books
+type listQuery struct {
+	limit  int
+	offset int
+
+	author string // author last name, case-insensitive
+	title  string // substring of the title, case-insensitive
+	isbn   string // hyphens and spaces ignored
+
+	sortBy string // "id", "title" or "isbn"
+	desc   bool   // sort=-title
+}
+
+func parseListQuery(values url.Values) (listQuery, error) {
+	q := listQuery{
+		limit:  defaultPageSize,
+		author: strings.TrimSpace(values.Get("author")),
+		title:  strings.TrimSpace(values.Get("title")),
+		isbn:   model.NormalizeISBN(values.Get("isbn")),
+	}
+	var err error
+	if v := values.Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit < 1 || q.limit > maxPageSize {
+			return q, fmt.Errorf("limit must be a number between 1 and %d", maxPageSize)
+		}
+	}
+	if v := values.Get("offset"); v != "" {
+		if q.offset, err = strconv.Atoi(v); err != nil || q.offset < 0 {
+			return q, fmt.Errorf("offset must be a number of 0 or more")
+		}
+	}
+	if v := values.Get("sort"); v != "" {
+		q.desc = strings.HasPrefix(v, "-")
+		q.sortBy = strings.TrimPrefix(v, "-")
+		switch q.sortBy {
+		case "id", "title", "isbn":
+		default:
+			return q, fmt.Errorf("sort must be one of id, title or isbn, optionally prefixed with -")
+		}
+	}
+	return q, nil
+}
+
+// apply filters and sorts books and cuts out the requested page. total is
+// the number of matches before paging.
+func (q listQuery) apply(books []Book) (page []Book, total int) {
+	matches := make([]Book, 0, len(books))
+	for _, b := range books {
+		if q.matches(b) {
+			matches = append(matches, b)
+		}
+	}
+	if q.sortBy != "" {
+		sort.SliceStable(matches, func(i, j int) bool {
+			a, b := sortKey(matches[i], q.sortBy), sortKey(matches[j], q.sortBy)
+			if q.desc {
+				return a > b
+			}
+			return a < b
+		})
+	}
+
+	total = len(matches)
+	if q.offset >= total {
+		return []Book{}, total
+	}
+	end := q.offset + q.limit
+	if end > total {
+		end = total
+	}
+	return matches[q.offset:end], total
+}
+
+func (q listQuery) matches(b Book) bool {
+	if q.author != "" && (b.Author == nil || !strings.EqualFold(b.Author.Lastname, q.author)) {
+		return false
+	}
+	if q.title != "" && !strings.Contains(strings.ToLower(b.Title), strings.ToLower(q.title)) {
+		return false
+	}
+	if q.isbn != "" && model.NormalizeISBN(b.Isbn) != q.isbn {
+		return false
+	}
+	return true
+}
+
+func sortKey(b Book, field string) string {
+	switch field {
+	case "title":
+		return strings.ToLower(b.Title)
+	case "isbn":
+		return model.NormalizeISBN(b.Isbn)
+	default:
+		return b.ID
+	}
+}
+
+// setPageHeaders adds X-Total-Count and an RFC 8288 Link header pointing at
+// the first, previous, next and last pages of the same query
+func setPageHeaders(w http.ResponseWriter, r *http.Request, q listQuery, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	link := func(offset int, rel string) string {
+		values := r.URL.Query()
+		values.Set("limit", strconv.Itoa(q.limit))
+		values.Set("offset", strconv.Itoa(offset))
+		u := url.URL{Path: r.URL.Path, RawQuery: values.Encode()}
+		return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+	}
+	lastOffset := 0
+	if total > 0 {
+		lastOffset = (total - 1) / q.limit * q.limit
+	}
+	links := []string{link(0, "first")}
+	if q.offset > 0 {
+		prev := q.offset - q.limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link(prev, "prev"))
+	}
+	if q.offset+q.limit < total {
+		links = append(links, link(q.offset+q.limit, "next"))
+	}
+	links = append(links, link(lastOffset, "last"))
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var sampleBooks = []Book{
+	{ID: "1", Title: "The Go Programming Language", Isbn: "978-0134190440", Author: &Author{Firstname: "Alan", Lastname: "Donovan"}},
+	{ID: "2", Title: "Concurrency in Go", Isbn: "9781491941195", Author: &Author{Firstname: "Katherine", Lastname: "Cox-Buday"}},
+	{ID: "3", Title: "Learning Go", Isbn: "9781492077213", Author: &Author{Firstname: "Jon", Lastname: "Bodner"}},
+	{ID: "4", Title: "Anonymous pamphlet"},
+}
+
+func TestListQueryApply(t *testing.T) {
+	tests := []struct {
+		query     string
+		wantIDs   string
+		wantTotal int
+	}{
+		{"", "1,2,3,4", 4},
+		{"limit=2", "1,2", 4},
+		{"limit=2&offset=2", "3,4", 4},
+		{"offset=10", "", 4},
+		{"author=donovan", "1", 1},
+		{"title=GO", "1,2,3", 3},
+		{"isbn=9780134190440", "1", 1},
+		{"sort=title", "4,2,3,1", 4},
+		{"sort=-id", "4,3,2,1", 4},
+		{"title=go&sort=-title&limit=1", "1", 3},
+	}
+	for _, tc := range tests {
+		values, _ := url.ParseQuery(tc.query)
+		q, err := parseListQuery(values)
+		if err != nil {
+			t.Fatalf("parseListQuery(%q): %v", tc.query, err)
+		}
+		page, total := q.apply(sampleBooks)
+		var got []string
+		for _, b := range page {
+			got = append(got, b.ID)
+		}
+		if strings.Join(got, ",") != tc.wantIDs || total != tc.wantTotal {
+			t.Errorf("%q: got %v of %d, want [%s] of %d", tc.query, got, total, tc.wantIDs, tc.wantTotal)
+		}
+	}
+}
+
+func TestParseListQueryRejectsBadValues(t *testing.T) {
+	for _, query := range []string{"limit=0", "limit=abc", "limit=501", "offset=-1", "sort=author"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseListQuery(values); err == nil {
+			t.Errorf("parseListQuery(%q) = nil error, want error", query)
+		}
+	}
+}
+
+func TestGetBooksPageHeaders(t *testing.T) {
+	useStore(t, sampleBooks...)
+
+	rec := do(t, newRouter(), "GET", "/api/books?limit=1&offset=1&sort=id", "")
+
+	var page []Book
+	json.NewDecoder(rec.Body).Decode(&page)
+	if rec.Code != http.StatusOK || len(page) != 1 || page[0].ID != "2" {
+		t.Fatalf("GET = %d %+v, want book 2 only", rec.Code, page)
+	}
+	if got := rec.Header().Get("X-Total-Count"); got != "4" {
+		t.Errorf("X-Total-Count = %q, want 4", got)
+	}
+	link := rec.Header().Get("Link")
+	for _, want := range []string{
+		`</api/books?limit=1&offset=0&sort=id>; rel="first"`,
+		`</api/books?limit=1&offset=0&sort=id>; rel="prev"`,
+		`</api/books?limit=1&offset=2&sort=id>; rel="next"`,
+		`</api/books?limit=1&offset=3&sort=id>; rel="last"`,
+	} {
+		if !strings.Contains(link, want) {
+			t.Errorf("Link = %s\nmissing %s", link, want)
+		}
+	}
+
+	if rec := do(t, newRouter(), "GET", "/api/books?limit=-5", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("GET with limit=-5 = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateSpec is a token bucket: clients get burst requests up front and
+// then rate requests per second. A zero rate means no limit.
+type rateSpec struct {
+	rate  float64
+	burst int
+}
+
+// readLimit and writeLimit apply to every read and write route separately,
+// per client; set up from the config in main
+var (
+	readLimit  rateSpec
+	writeLimit rateSpec
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps one token bucket per client
+type rateLimiter struct {
+	spec rateSpec
+	now  func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(spec rateSpec) *rateLimiter {
+	return &rateLimiter{spec: spec, now: time.Now, buckets: map[string]*bucket{}}
+}
+
+// allow takes a token from key's bucket if there is one. It also reports
+// how many tokens are left, how long until the bucket is full again and,
+// when refused, how long until the next token.
+func (l *rateLimiter) allow(key string) (ok bool, remaining int, reset, retry time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(l.spec.burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.spec.burst), b.tokens+now.Sub(b.last).Seconds()*l.spec.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		retry = l.secondsFor(1 - b.tokens)
+	}
+	return ok, int(b.tokens), l.secondsFor(float64(l.spec.burst) - b.tokens), retry
+}
+
+func (l *rateLimiter) secondsFor(tokens float64) time.Duration {
+	return time.Duration(tokens / l.spec.rate * float64(time.Second))
+}
+
+// sweep drops the buckets of clients that have been quiet long enough for
+// their bucket to fill up, which is the same as not having one. It runs at
+// most once a minute so it doesn't cost every request a pass over the map.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := l.secondsFor(float64(l.spec.burst))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimited puts h behind a limiter of its own, so each route is limited
+// separately. Clients are told where they stand in RateLimit-* headers and
+// refused with a 429 and Retry-After once their bucket is empty.
+func rateLimited(spec rateSpec, h http.HandlerFunc) http.HandlerFunc {
+	if spec.rate <= 0 {
+		return h
+	}
+	l := newRateLimiter(spec)
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, remaining, reset, retry := l.allow(clientKey(r))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(spec.burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retry)))
+			writeProblem(w, r, http.StatusTooManyRequests, "rate limit exceeded, slow down")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// clientKey identifies who a request counts against: the owner of its API
+// key if the key is valid, otherwise the connecting IP
+func clientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return limitKey(r.Header.Get("X-API-Key"), host)
+}
+
+// limitKey is the rate limit bucket for a client that sent apiKey from ip.
+// Keys only count once auth accepts them, or a client could get a fresh
+// bucket for every request by making keys up. We don't trust
+// X-Forwarded-For either, since any client can set it.
+func limitKey(apiKey, ip string) string {
+	if apiKey != "" {
+		if p, err := auth.credentials(apiKey, ""); err == nil {
+			return "key:" + p.Subject
+		}
+	}
+	return "ip:" + ip
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// errBodyTooLarge is what reading a request body past the limit gives
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitBody caps the size of POST, PUT and PATCH bodies; handlers see
+// errBodyTooLarge when reading past the cap and answer 413
+func limitBody(max int64) middleware {
+	return func(next http.Handler) http.Handler {
+		if max <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch:
+				if r.ContentLength > max {
+					writeProblem(w, r, http.StatusRequestEntityTooLarge, "request body is larger than "+strconv.FormatInt(max, 10)+" bytes")
+					return
+				}
+				r.Body = &limitedBody{ReadCloser: r.Body, remaining: max}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	// read one byte more than allowed to find out if there is more
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = -1
+		return n, errBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefills(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(rateSpec{rate: 2, burst: 3})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, remaining, _, _ := l.allow("a"); !ok || remaining != 2-i {
+			t.Fatalf("request %d: ok=%v remaining=%d, want ok with %d left", i+1, ok, remaining, 2-i)
+		}
+	}
+	ok, _, reset, retry := l.allow("a")
+	if ok || retry != 500*time.Millisecond || reset != 1500*time.Millisecond {
+		t.Fatalf("4th request: ok=%v reset=%s retry=%s, want refused, reset 1.5s, retry 0.5s", ok, reset, retry)
+	}
+	if ok, _, _, _ := l.allow("b"); !ok {
+		t.Error("another client was refused")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _, _, _ := l.allow("a"); !ok {
+		t.Error("refused after waiting Retry-After")
+	}
+
+	now = now.Add(time.Hour)
+	l.allow("c") // sweeps the idle buckets
+	if _, found := l.buckets["a"]; found {
+		t.Error("idle bucket was kept")
+	}
+}
+
+func TestRateLimitedRoutes(t *testing.T) {
+	saved := readLimit
+	defer func() { readLimit = saved }()
+	readLimit = rateSpec{rate: 0.001, burst: 2}
+	useStore(t, Book{ID: "1", Title: "Sample book", Author: &Author{Lastname: "Smith"}})
+	router := newRouter()
+
+	get := func(path, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-API-Key", apiKey)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	get("/api/books", "")
+	rec := get("/api/books", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("2nd request = %d %v, want 200 with no requests left", rec.Code, rec.Header())
+	}
+	rec = get("/api/books", "")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" ||
+		rec.Header().Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("3rd request = %d %v, want a 429 problem with Retry-After", rec.Code, rec.Header())
+	}
+
+	if rec := get("/api/books/1", ""); rec.Code != http.StatusOK {
+		t.Errorf("other route = %d, want its own limit", rec.Code)
+	}
+	if rec := get("/api/books", testAPIKey); rec.Code != http.StatusOK {
+		t.Errorf("same IP with an API key = %d, want a separate limit", rec.Code)
+	}
+	// made-up keys count against the IP, like no key at all
+	for i := 0; i < 3; i++ {
+		if rec := get("/api/books", "junk-"+strconv.Itoa(i)); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("request with made-up key %d = %d, want 429", i, rec.Code)
+		}
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	useStore(t)
+	h := limitBody(64)(newRouter())
+	big := `{"title":"` + strings.Repeat("x", 100) + `","author":{"lastname":"Smith"}}`
+
+	tests := []struct {
+		name       string
+		body       io.Reader
+		wantStatus int
+	}{
+		{"small", strings.NewReader(`{"title":"Go","author":{"lastname":"Smith"}}`), http.StatusCreated},
+		{"too large, with Content-Length", strings.NewReader(big), http.StatusRequestEntityTooLarge},
+		{"too large, chunked", io.MultiReader(strings.NewReader(big)), http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("POST", "/api/books", tc.body)
+		req.Header.Set("X-API-Key", testAPIKey)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: POST = %d, want %d (body %s)", tc.name, rec.Code, tc.wantStatus, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/rest/model"
+)
+
+// how much a query word counts for, by where in the book it was found
+const (
+	isbnWeight      = 4
+	titleWeight     = 3
+	lastnameWeight  = 2
+	firstnameWeight = 1
+)
+
+// searchIndex is an inverted index from the words in a book's title, its
+// author's names and its ISBN to the books they appear in. It is not safe
+// for concurrent use; memoryStore guards it with its own lock.
+type searchIndex struct {
+	postings map[string]map[string]int // term -> book ID -> weight
+	terms    []string                  // every term in postings, sorted for prefix lookups
+	docs     map[string][]string       // book ID -> its terms, to take it out again
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{postings: map[string]map[string]int{}, docs: map[string][]string{}}
+}
+
+// add indexes book under author's names, replacing whatever was indexed
+// for the book before. author may be nil.
+func (x *searchIndex) add(book Book, author *Author) {
+	x.remove(book.ID)
+	weights := map[string]int{}
+	field := func(text string, weight int) {
+		for _, t := range tokenize(text) {
+			if weight > weights[t] {
+				weights[t] = weight
+			}
+		}
+	}
+	field(book.Title, titleWeight)
+	if author != nil {
+		field(author.Lastname, lastnameWeight)
+		field(author.Firstname, firstnameWeight)
+	}
+	if isbn := strings.ToLower(model.NormalizeISBN(book.Isbn)); isbn != "" {
+		weights[isbn] = isbnWeight
+	}
+
+	terms := make([]string, 0, len(weights))
+	for t, w := range weights {
+		ids, ok := x.postings[t]
+		if !ok {
+			ids = map[string]int{}
+			x.postings[t] = ids
+			i := sort.SearchStrings(x.terms, t)
+			x.terms = append(x.terms, "")
+			copy(x.terms[i+1:], x.terms[i:])
+			x.terms[i] = t
+		}
+		ids[book.ID] = w
+		terms = append(terms, t)
+	}
+	x.docs[book.ID] = terms
+}
+
+// remove takes the book out of the index, if it is in there
+func (x *searchIndex) remove(id string) {
+	for _, t := range x.docs[id] {
+		delete(x.postings[t], id)
+		if len(x.postings[t]) == 0 {
+			delete(x.postings, t)
+			i := sort.SearchStrings(x.terms, t)
+			x.terms = append(x.terms[:i], x.terms[i+1:]...)
+		}
+	}
+	delete(x.docs, id)
+}
+
+// search scores the books matching every word of query. A word matches any
+// indexed term it is a prefix of, so "prog" finds "Programming"; a whole
+// word scores twice what a prefix does. Books that miss a word are left out.
+func (x *searchIndex) search(query string) map[string]int {
+	var scores map[string]int
+	for _, word := range tokenize(query) {
+		best := map[string]int{}
+		for i := sort.SearchStrings(x.terms, word); i < len(x.terms) && strings.HasPrefix(x.terms[i], word); i++ {
+			t := x.terms[i]
+			for id, w := range x.postings[t] {
+				if t == word {
+					w *= 2
+				}
+				if w > best[id] {
+					best[id] = w
+				}
+			}
+		}
+		if scores == nil {
+			scores = best
+			continue
+		}
+		for id := range scores {
+			if w, ok := best[id]; ok {
+				scores[id] += w
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	return scores
+}
+
+// tokenize splits text into lower-case words. Hyphens join words
+// ("Cox-Buday" is "cox" and "buday") except inside an ISBN, which is kept
+// whole without them.
+func tokenize(text string) []string {
+	var words []string
+	for _, f := range strings.FieldsFunc(text, func(r rune) bool {
+		return r != '-' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if isbn := model.NormalizeISBN(f); looksLikeISBN(isbn) {
+			words = append(words, strings.ToLower(isbn))
+			continue
+		}
+		for _, w := range strings.Split(f, "-") {
+			if w != "" {
+				words = append(words, strings.ToLower(w))
+			}
+		}
+	}
+	return words
+}
+
+// looksLikeISBN is true for digits, possibly ending in an X check digit,
+// which is what an ISBN (or the start of one) is once the hyphens are gone
+func looksLikeISBN(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !(c >= '0' && c <= '9' || (c == 'X' || c == 'x') && i == len(s)-1 && i > 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchBooks answers GET /api/books/search?q= with the matching books,
+// best match first. The list filters and paging work here too.
+func searchBooks(w http.ResponseWriter, r *http.Request) {
+	text := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len(tokenize(text)) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, "q must contain at least one word to search for")
+		return
+	}
+	q, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	books, err := store.Search(text)
+	if err == nil {
+		books, err = withAuthors(books)
+	}
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	page, total := q.apply(books)
+	setPageHeaders(w, r, q, total)
+	writeJSON(w, http.StatusOK, present(r, page))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := map[string][]string{
+		"The Go Programming Language": {"the", "go", "programming", "language"},
+		"Cox-Buday":                   {"cox", "buday"},
+		"978-0-13-419044-0":           {"9780134190440"},
+		"0-8044-2957-X":               {"080442957x"},
+		"Go, in ÉCOLE":                {"go", "in", "école"},
+		"  --  ":                      nil,
+	}
+	for text, want := range tests {
+		if got := tokenize(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("tokenize(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+// searchIDs runs a search against a store holding sampleBooks
+func searchIDs(t *testing.T, s BookStore, query string) string {
+	t.Helper()
+	books, err := s.Search(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, b := range books {
+		got = append(got, b.ID)
+	}
+	return strings.Join(got, ",")
+}
+
+func TestSearchRanksMatches(t *testing.T) {
+	useStore(t, sampleBooks...)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"go", "1,2,3"},
+		{"GO", "1,2,3"},
+		{"prog", "1"},
+		{"go lang", "1"},
+		{"donovan", "1"},
+		{"katherine cox", "2"},
+		{"buday", "2"},
+		{"978-1-4920-7721-3", "3"},
+		{"978149", "2,3"},
+		{"learning go", "3"},
+		{"go learn", "3"},
+		{"rust", ""},
+		{"go rust", ""},
+	}
+	for _, tc := range tests {
+		if got := searchIDs(t, store, tc.query); got != tc.want {
+			t.Errorf("Search(%q) = [%s], want [%s]", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestSearchPrefersWholeWordsAndTitles(t *testing.T) {
+	useStore(t,
+		Book{ID: "1", Title: "Gopher tales", Author: &Author{Lastname: "Smith"}},
+		Book{ID: "2", Title: "Travels", Author: &Author{Lastname: "Go"}},
+		Book{ID: "3", Title: "Go for beginners", Author: &Author{Lastname: "Jones"}},
+	)
+	// a whole word beats a prefix, and the title beats the author's name
+	if got := searchIDs(t, store, "go"); got != "3,2,1" {
+		t.Errorf(`Search("go") = [%s], want [3,2,1]`, got)
+	}
+}
+
+func TestSearchIndexFollowsChanges(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Old title", Author: &Author{Lastname: "Smith"}})
+	router := newRouter()
+	search := func(query string) string {
+		t.Helper()
+		rec := do(t, router, "GET", "/api/books/search?q="+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("search %q = %d %s", query, rec.Code, rec.Body)
+		}
+		var books []Book
+		json.NewDecoder(rec.Body).Decode(&books)
+		var got []string
+		for _, b := range books {
+			got = append(got, b.ID)
+		}
+		return strings.Join(got, ",")
+	}
+
+	rec := do(t, router, "POST", "/api/books", `{"title":"Brand new","author":{"lastname":"Jones"}}`)
+	var created Book
+	json.NewDecoder(rec.Body).Decode(&created)
+	if got := search("brand"); got != created.ID {
+		t.Errorf("after create, search brand = [%s], want [%s]", got, created.ID)
+	}
+
+	do(t, router, "PUT", "/api/books/1", `{"title":"Fresh title","author":{"lastname":"Smith"}}`)
+	if got := search("old"); got != "" {
+		t.Errorf("after update, search old = [%s], want none", got)
+	}
+	if got := search("fresh"); got != "1" {
+		t.Errorf("after update, search fresh = [%s], want [1]", got)
+	}
+
+	req := editorRequest("PATCH", "/api/books/1", `{"title":"Patched"}`)
+	req.Header.Set("Content-Type", mergePatchType)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if got := search("patched"); got != "1" {
+		t.Errorf("after patch, search patched = [%s], want [1]", got)
+	}
+
+	authorID := storedBook(t, "1").AuthorID
+	do(t, router, "PUT", "/api/authors/"+authorID, `{"firstname":"Ann","lastname":"Smythe"}`)
+	if got := search("smythe"); got != "1" {
+		t.Errorf("after renaming the author, search smythe = [%s], want [1]", got)
+	}
+	if got := search("smith"); got != "" {
+		t.Errorf("after renaming the author, search smith = [%s], want none", got)
+	}
+
+	do(t, router, "DELETE", "/api/books/"+created.ID, "")
+	if got := search("brand"); got != "" {
+		t.Errorf("after delete, search brand = [%s], want none", got)
+	}
+}
+
+func TestSearchEndpoint(t *testing.T) {
+	useStore(t, sampleBooks...)
+	router := newRouter()
+
+	rec := do(t, router, "GET", "/api/books/search?q=go&limit=2&expand=author", "")
+	var books []Book
+	json.NewDecoder(rec.Body).Decode(&books)
+	if rec.Code != http.StatusOK || len(books) != 2 || rec.Header().Get("X-Total-Count") != "3" {
+		t.Fatalf("search go = %d with %d books of %s, want 200 with 2 of 3", rec.Code, len(books), rec.Header().Get("X-Total-Count"))
+	}
+	if books[0].Author == nil {
+		t.Error("expand=author left out the author")
+	}
+
+	for _, path := range []string{"/api/books/search", "/api/books/search?q=+-+", "/api/books/search?q=go&limit=0"} {
+		if rec := do(t, router, "GET", path, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", path, rec.Code)
+		}
+	}
+}
+
+func TestFileStoreSearchesReloadedBooks(t *testing.T) {
+	path := t.TempDir() + "/books.json"
+	s, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CreateAuthor(Author{ID: "a1", Lastname: "Donovan"})
+	s.Create(Book{ID: "1", Title: "The Go Programming Language", AuthorID: "a1"})
+
+	reopened, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIDs(t, reopened, "donovan prog"); got != "1" {
+		t.Errorf("reopened store: search = [%s], want [1]", got)
+	}
+}
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrBookNotFound is returned by a BookStore when no book has the given ID
+var ErrBookNotFound = errors.New("book not found")
+
+// ErrBookDeleted is returned for a book that has been deleted but not yet
+// purged. It is an ErrBookNotFound, so callers that don't care about the
+// difference needn't check for it.
+var ErrBookDeleted = fmt.Errorf("%w: it has been deleted", ErrBookNotFound)
+
+// ErrNotDeleted is returned by Undelete for a book that is still there
+var ErrNotDeleted = errors.New("book has not been deleted")
+
+// ErrDuplicateID is returned by Create when the ID is already taken
+var ErrDuplicateID = errors.New("book id already exists")
+
+// ErrAuthorNotFound is returned when no author has the given ID, including
+// when a book refers to an author that doesn't exist
+var ErrAuthorNotFound = errors.New("author not found")
+
+// ErrAuthorInUse is returned by DeleteAuthor while books still refer to the author
+var ErrAuthorInUse = errors.New("author still has books")
+
+// ErrVersionConflict is returned by Update and Delete when the book is no
+// longer at the version the caller expected
+var ErrVersionConflict = errors.New("book was changed by someone else")
+
+// BookStore is the persistence layer behind the book handlers. net/http
+// serves every request on its own goroutine, so implementations must be
+// safe for concurrent use.
+//
+// The store owns Book.Version: Create starts it at 1 and every Update bumps
+// it. Update and Delete take the version the caller last saw (book.Version
+// and version respectively) and fail with ErrVersionConflict if the stored
+// book has moved on since; 0 means "whatever is stored now".
+//
+// Authors live in the same store so it can keep books and authors
+// consistent: a book's AuthorID must name a stored author, and an author
+// can't be deleted while books refer to it.
+//
+// Search finds books by the words in their title, author's names or ISBN,
+// best match first; see searchIndex.
+//
+// Delete only hides a book: it is kept as a tombstone, which still holds
+// on to its ID, until Undelete brings it back or Purge removes tombstones
+// older than a cutoff for good. Every change to a book goes into its
+// History, credited to book.UpdatedBy (or by, for Delete and Undelete);
+// the store stamps book.UpdatedAt itself.
+type BookStore interface {
+	List() ([]Book, error)
+	// Page returns up to limit books from offset on, in List's order
+	Page(offset, limit int) ([]Book, error)
+	Get(id string) (Book, error)
+	Search(query string) ([]Book, error)
+	Create(book Book) (Book, error)
+	// CreateMany creates authors, then books, in one change. created[i]
+	// and errs[i] are what Create would have returned for books[i]; err is
+	// for the change as a whole, which then creates nothing, and is
+	// ErrDuplicateID if one of the authors' IDs is taken.
+	CreateMany(authors []Author, books []Book) (created []Book, errs []error, err error)
+	Update(id string, book Book) (Book, error)
+	Delete(id string, version int, by string) error
+	Undelete(id, by string) (Book, error)
+	History(id string) ([]Change, error)
+	Purge(before time.Time) (int, error)
+
+	ListAuthors() ([]Author, error)
+	GetAuthor(id string) (Author, error)
+	CreateAuthor(author Author) (Author, error)
+	UpdateAuthor(id string, author Author) (Author, error)
+	DeleteAuthor(id string) error
+}
+
+// catalogue is everything a store holds, as written to the data file
+type catalogue struct {
+	Books   []Book              `json:"books"`
+	Authors []Author            `json:"authors"`
+	Deleted []tombstone         `json:"deleted,omitempty"`
+	History map[string][]Change `json:"history,omitempty"` // by book ID
+}
+
+// tombstone is a deleted book, kept until it is purged
+type tombstone struct {
+	Book      Book      `json:"book"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy string    `json:"deleted_by,omitempty"`
+}
+
+// openStore returns the backend selected at startup ("memory" or "file")
+func openStore(kind, path string) (BookStore, error) {
+	switch kind {
+	case "memory":
+		return newMemoryStore(), nil
+	case "file":
+		return newFileStore(path)
+	default:
+		return nil, fmt.Errorf("unknown store %q (want memory or file)", kind)
+	}
+}
+
+// freshStore says whether openStore will start from nothing: always for
+// the memory store, and for the file store if its file doesn't exist yet.
+// A file whose books have all been deleted is not fresh.
+func freshStore(kind, path string) (bool, error) {
+	if kind != "file" {
+		return true, nil
+	}
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	return false, err
+}
+
+// memoryStore keeps books and authors in slices, in insertion order, and
+// indexes the books for Search as they change
+type memoryStore struct {
+	mu      sync.RWMutex
+	books   []Book
+	authors []Author
+	deleted []tombstone
+	history map[string][]Change
+	index   *searchIndex
+	now     func() time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{history: map[string][]Change{}, index: newSearchIndex(), now: time.Now}
+}
+
+func (s *memoryStore) List() ([]Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	// hand out a copy so callers can't modify the store behind our back
+	return append([]Book(nil), s.books...), nil
+}
+
+func (s *memoryStore) Page(offset, limit int) ([]Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if offset >= len(s.books) {
+		return nil, nil
+	}
+	end := len(s.books)
+	if limit < end-offset {
+		end = offset + limit
+	}
+	return append([]Book(nil), s.books[offset:end]...), nil
+}
+
+func (s *memoryStore) Get(id string) (Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.indexOf(id)
+	if i < 0 {
+		return Book{}, s.missing(id)
+	}
+	return s.books[i], nil
+}
+
+// Search returns the books matching query by relevance; equally good
+// matches stay in insertion order
+func (s *memoryStore) Search(query string) ([]Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	scores := s.index.search(query)
+	matches := make([]Book, 0, len(scores))
+	for _, b := range s.books {
+		if _, ok := scores[b.ID]; ok {
+			matches = append(matches, b)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return scores[matches[i].ID] > scores[matches[j].ID]
+	})
+	return matches, nil
+}
+
+func (s *memoryStore) Create(book Book) (Book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.create(book)
+}
+
+// create is Create with s.mu held
+func (s *memoryStore) create(book Book) (Book, error) {
+	if s.indexOf(book.ID) >= 0 || s.indexOfDeleted(book.ID) >= 0 {
+		return Book{}, ErrDuplicateID
+	}
+	if !s.authorExists(book.AuthorID) {
+		return Book{}, ErrAuthorNotFound
+	}
+	book.Version = 1
+	book.UpdatedAt = s.now().UTC()
+	s.books = append(s.books, book)
+	s.index.add(book, s.authorOf(book))
+	s.record(book, "created", book.UpdatedBy, book.UpdatedAt, diffBooks(Book{}, book))
+	return book, nil
+}
+
+func (s *memoryStore) CreateMany(authors []Author, books []Book) ([]Book, []error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	taken := map[string]bool{}
+	for _, a := range authors {
+		if taken[a.ID] || s.indexOfAuthor(a.ID) >= 0 {
+			return nil, nil, ErrDuplicateID
+		}
+		taken[a.ID] = true
+	}
+	s.authors = append(s.authors, authors...)
+	created := make([]Book, len(books))
+	errs := make([]error, len(books))
+	for i, b := range books {
+		created[i], errs[i] = s.create(b)
+	}
+	return created, errs, nil
+}
+
+func (s *memoryStore) Update(id string, book Book) (Book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexOf(id)
+	if i < 0 {
+		return Book{}, s.missing(id)
+	}
+	before := s.books[i]
+	if book.Version != 0 && book.Version != before.Version {
+		return Book{}, ErrVersionConflict
+	}
+	if !s.authorExists(book.AuthorID) {
+		return Book{}, ErrAuthorNotFound
+	}
+	book.Version = before.Version + 1
+	book.UpdatedAt = s.now().UTC()
+	s.books[i] = book
+	s.index.add(book, s.authorOf(book))
+	s.record(book, "updated", book.UpdatedBy, book.UpdatedAt, diffBooks(before, book))
+	return book, nil
+}
+
+func (s *memoryStore) Delete(id string, version int, by string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexOf(id)
+	if i < 0 {
+		return s.missing(id)
+	}
+	book := s.books[i]
+	if version != 0 && version != book.Version {
+		return ErrVersionConflict
+	}
+	s.books = append(s.books[:i], s.books[i+1:]...)
+	deletedAt := s.now().UTC()
+	s.deleted = append(s.deleted, tombstone{Book: book, DeletedAt: deletedAt, DeletedBy: by})
+	s.index.remove(id)
+	s.record(book, "deleted", by, deletedAt, nil)
+	return nil
+}
+
+// Undelete puts a deleted book back as a new version. It fails with
+// ErrAuthorNotFound if the book's author has been deleted in the meantime.
+func (s *memoryStore) Undelete(id, by string) (Book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexOfDeleted(id)
+	if i < 0 {
+		if s.indexOf(id) >= 0 {
+			return Book{}, ErrNotDeleted
+		}
+		return Book{}, ErrBookNotFound
+	}
+	book := s.deleted[i].Book
+	if !s.authorExists(book.AuthorID) {
+		return Book{}, ErrAuthorNotFound
+	}
+	s.deleted = append(s.deleted[:i], s.deleted[i+1:]...)
+	book.Version++
+	book.UpdatedAt = s.now().UTC()
+	book.UpdatedBy = by
+	s.books = append(s.books, book)
+	s.index.add(book, s.authorOf(book))
+	s.record(book, "undeleted", by, book.UpdatedAt, nil)
+	return book, nil
+}
+
+// History lists the changes to a book, oldest first, as long as the book
+// or its tombstone is around
+func (s *memoryStore) History(id string) ([]Change, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.indexOf(id) < 0 && s.indexOfDeleted(id) < 0 {
+		return nil, ErrBookNotFound
+	}
+	return append([]Change{}, s.history[id]...), nil
+}
+
+// Purge removes the books deleted before the cutoff for good, history and
+// all, and says how many there were
+func (s *memoryStore) Purge(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.deleted[:0]
+	for _, t := range s.deleted {
+		if t.DeletedAt.Before(before) {
+			delete(s.history, t.Book.ID)
+		} else {
+			kept = append(kept, t)
+		}
+	}
+	purged := len(s.deleted) - len(kept)
+	s.deleted = kept
+	return purged, nil
+}
+
+func (s *memoryStore) ListAuthors() ([]Author, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Author(nil), s.authors...), nil
+}
+
+func (s *memoryStore) GetAuthor(id string) (Author, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.indexOfAuthor(id)
+	if i < 0 {
+		return Author{}, ErrAuthorNotFound
+	}
+	return s.authors[i], nil
+}
+
+func (s *memoryStore) CreateAuthor(author Author) (Author, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.indexOfAuthor(author.ID) >= 0 {
+		return Author{}, ErrDuplicateID
+	}
+	s.authors = append(s.authors, author)
+	return author, nil
+}
+
+func (s *memoryStore) UpdateAuthor(id string, author Author) (Author, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexOfAuthor(id)
+	if i < 0 {
+		return Author{}, ErrAuthorNotFound
+	}
+	s.authors[i] = author
+	// the author's books are found under the new name from now on
+	for _, b := range s.books {
+		if b.AuthorID == id {
+			s.index.add(b, &author)
+		}
+	}
+	return author, nil
+}
+
+func (s *memoryStore) DeleteAuthor(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexOfAuthor(id)
+	if i < 0 {
+		return ErrAuthorNotFound
+	}
+	for _, b := range s.books {
+		if b.AuthorID == id {
+			return ErrAuthorInUse
+		}
+	}
+	// deleted books keep their author ID; Undelete checks it is still good
+	s.authors = append(s.authors[:i], s.authors[i+1:]...)
+	return nil
+}
+
+// snapshot copies everything in the store
+func (s *memoryStore) snapshot() catalogue {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history := make(map[string][]Change, len(s.history))
+	for id, changes := range s.history {
+		history[id] = append([]Change(nil), changes...)
+	}
+	return catalogue{
+		Books:   append([]Book(nil), s.books...),
+		Authors: append([]Author(nil), s.authors...),
+		Deleted: append([]tombstone(nil), s.deleted...),
+		History: history,
+	}
+}
+
+// restore swaps in a whole new catalogue
+func (s *memoryStore) restore(c catalogue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.books = c.Books
+	s.authors = c.Authors
+	s.deleted = c.Deleted
+	s.history = c.History
+	if s.history == nil {
+		s.history = map[string][]Change{}
+	}
+	s.index = newSearchIndex()
+	for _, b := range s.books {
+		s.index.add(b, s.authorOf(b))
+	}
+}
+
+// indexOf must be called with s.mu held
+func (s *memoryStore) indexOf(id string) int {
+	for i, item := range s.books {
+		if item.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexOfDeleted must be called with s.mu held
+func (s *memoryStore) indexOfDeleted(id string) int {
+	for i, t := range s.deleted {
+		if t.Book.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// missing is the error for a book that isn't there: ErrBookDeleted if it
+// was, ErrBookNotFound if it never was. It must be called with s.mu held.
+func (s *memoryStore) missing(id string) error {
+	if s.indexOfDeleted(id) >= 0 {
+		return ErrBookDeleted
+	}
+	return ErrBookNotFound
+}
+
+// record adds a change to the book's history. It must be called with s.mu
+// held.
+func (s *memoryStore) record(book Book, action, by string, at time.Time, diff map[string]FieldDiff) {
+	s.history[book.ID] = append(s.history[book.ID], Change{
+		Version: book.Version,
+		Action:  action,
+		By:      by,
+		At:      at,
+		Diff:    diff,
+	})
+}
+
+// indexOfAuthor must be called with s.mu held
+func (s *memoryStore) indexOfAuthor(id string) int {
+	for i, item := range s.authors {
+		if item.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// authorOf finds the author a book is indexed under: the stored one, or
+// for books saved before authors had IDs, the one embedded in the book. It
+// must be called with s.mu held.
+func (s *memoryStore) authorOf(book Book) *Author {
+	if i := s.indexOfAuthor(book.AuthorID); book.AuthorID != "" && i >= 0 {
+		a := s.authors[i]
+		return &a
+	}
+	return book.Author
+}
+
+// authorExists must be called with s.mu held. Books saved before authors
+// had IDs have none, and are let through until they are migrated.
+func (s *memoryStore) authorExists(id string) bool {
+	return id == "" || s.indexOfAuthor(id) >= 0
+}
+
+// fileStore is a memoryStore that writes the whole catalogue to a JSON file
+// after every change and reads it back on startup. Reads go straight to the
+// memoryStore; mu serialises writers so each change is saved before the
+// next one starts.
+type fileStore struct {
+	mu   sync.Mutex
+	path string
+	mem  *memoryStore
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	s := &fileStore{path: path, mem: newMemoryStore()}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c catalogue
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+		// files written before authors had their own IDs are a bare list of books
+		err = json.Unmarshal(data, &c.Books)
+	} else {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	// files written before books were versioned
+	for i := range c.Books {
+		if c.Books[i].Version == 0 {
+			c.Books[i].Version = 1
+		}
+	}
+	s.mem.restore(c)
+	return s, nil
+}
+
+func (s *fileStore) List() ([]Book, error) {
+	return s.mem.List()
+}
+
+func (s *fileStore) Page(offset, limit int) ([]Book, error) {
+	return s.mem.Page(offset, limit)
+}
+
+func (s *fileStore) Get(id string) (Book, error) {
+	return s.mem.Get(id)
+}
+
+func (s *fileStore) Search(query string) ([]Book, error) {
+	return s.mem.Search(query)
+}
+
+func (s *fileStore) Create(book Book) (created Book, err error) {
+	err = s.change(func() error {
+		created, err = s.mem.Create(book)
+		return err
+	})
+	return created, err
+}
+
+// CreateMany saves the file once for the lot
+func (s *fileStore) CreateMany(authors []Author, books []Book) (created []Book, errs []error, err error) {
+	err = s.change(func() error {
+		created, errs, err = s.mem.CreateMany(authors, books)
+		return err
+	})
+	return created, errs, err
+}
+
+func (s *fileStore) Update(id string, book Book) (updated Book, err error) {
+	err = s.change(func() error {
+		updated, err = s.mem.Update(id, book)
+		return err
+	})
+	return updated, err
+}
+
+func (s *fileStore) Delete(id string, version int, by string) error {
+	return s.change(func() error { return s.mem.Delete(id, version, by) })
+}
+
+func (s *fileStore) Undelete(id, by string) (restored Book, err error) {
+	err = s.change(func() error {
+		restored, err = s.mem.Undelete(id, by)
+		return err
+	})
+	return restored, err
+}
+
+func (s *fileStore) History(id string) ([]Change, error) {
+	return s.mem.History(id)
+}
+
+func (s *fileStore) Purge(before time.Time) (purged int, err error) {
+	err = s.change(func() error {
+		purged, err = s.mem.Purge(before)
+		return err
+	})
+	return purged, err
+}
+
+func (s *fileStore) ListAuthors() ([]Author, error) {
+	return s.mem.ListAuthors()
+}
+
+func (s *fileStore) GetAuthor(id string) (Author, error) {
+	return s.mem.GetAuthor(id)
+}
+
+func (s *fileStore) CreateAuthor(author Author) (created Author, err error) {
+	err = s.change(func() error {
+		created, err = s.mem.CreateAuthor(author)
+		return err
+	})
+	return created, err
+}
+
+func (s *fileStore) UpdateAuthor(id string, author Author) (updated Author, err error) {
+	err = s.change(func() error {
+		updated, err = s.mem.UpdateAuthor(id, author)
+		return err
+	})
+	return updated, err
+}
+
+func (s *fileStore) DeleteAuthor(id string) error {
+	return s.change(func() error { return s.mem.DeleteAuthor(id) })
+}
+
+// Ping checks the data file's directory is still there and writable, which
+// every change needs
+func (s *fileStore) Ping() error {
+	f, err := os.CreateTemp(filepath.Dir(s.path), ".ping-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// change applies fn to the in-memory copy and saves it, rolling back if the
+// file can't be written so memory and disk don't drift apart
+func (s *fileStore) change(fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := s.mem.snapshot()
+	if err := fn(); err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		s.mem.restore(snapshot)
+		return err
+	}
+	return nil
+}
+
+// save writes to a temp file first, flushes it to disk and renames it
+// over the old one, then flushes the directory so the rename sticks too:
+// a crash mid-write never leaves a truncated catalogue behind
+func (s *fileStore) save() error {
+	data, err := json.MarshalIndent(s.mem.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.path))
+}
+
+// syncDir flushes a directory's entries to disk. Windows can't sync a
+// directory, and some file systems refuse to, which doesn't count as a
+// failure.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.json")
+
+	s, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Create(Book{ID: "1", Title: "Kept"})
+	s.Create(Book{ID: "2", Title: "Removed"})
+	s.Update("1", Book{ID: "1", Title: "Kept, edited"})
+	s.Delete("2", 0, "")
+
+	reopened, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, _ := reopened.List()
+	if len(books) != 1 || books[0].Title != "Kept, edited" {
+		t.Fatalf("reopened store has %+v, want only the edited book 1", books)
+	}
+	if _, err := reopened.Get("2"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf(`Get("2") error = %v, want ErrBookNotFound`, err)
+	}
+}
+
+func TestOpenStoreRejectsUnknownKind(t *testing.T) {
+	if _, err := openStore("postgres", ""); err == nil {
+		t.Fatal(`openStore("postgres") = nil error, want error`)
+	}
+}
+
+func TestFreshStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.json")
+	if fresh, err := freshStore("memory", path); !fresh || err != nil {
+		t.Errorf("memory store: fresh = %v, %v, want true", fresh, err)
+	}
+	if fresh, err := freshStore("file", path); !fresh || err != nil {
+		t.Errorf("file store without a file: fresh = %v, %v, want true", fresh, err)
+	}
+
+	// a catalogue whose books have all gone is still somebody's catalogue
+	fs, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seedSampleData(fs); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2"} {
+		if err := fs.Delete(id, 0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.Purge(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if fresh, err := freshStore("file", path); fresh || err != nil {
+		t.Errorf("file store with every book purged: fresh = %v, %v, want false", fresh, err)
+	}
+
+	if err := seedSampleData(fs); err == nil {
+		t.Error("seeding a store that already has the sample authors succeeded, want an error")
+	}
+}
+
+func TestStoresAreSafeForConcurrentUse(t *testing.T) {
+	fs, err := newFileStore(filepath.Join(t.TempDir(), "books.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]BookStore{
+		"memory": newMemoryStore(),
+		"file":   fs,
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			const workers = 50
+			var wg sync.WaitGroup
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					id := strconv.Itoa(i)
+					s.Create(Book{ID: id, Title: "draft"})
+					s.Update(id, Book{ID: id, Title: "final"})
+					s.List()
+					s.Get(id)
+					if i%2 == 0 {
+						s.Delete(id, 0, "")
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			books, _ := s.List()
+			if len(books) != workers/2 {
+				t.Fatalf("%d books left, want %d", len(books), workers/2)
+			}
+			for _, b := range books {
+				if b.Title != "final" {
+					t.Errorf("book %s has title %q, want %q", b.ID, b.Title, "final")
+				}
+			}
+		})
+	}
+}
+
+func TestCreateRejectsDuplicateID(t *testing.T) {
+	s := newMemoryStore()
+	s.Create(Book{ID: "1", Title: "First"})
+	if _, err := s.Create(Book{ID: "1", Title: "Second"}); !errors.Is(err, ErrDuplicateID) {
+		t.Fatalf("second Create with ID 1: error = %v, want ErrDuplicateID", err)
+	}
+	if b, _ := s.Get("1"); b.Title != "First" {
+		t.Errorf("book 1 is %+v, want the first one kept", b)
+	}
+}
+
+func TestCreateMany(t *testing.T) {
+	fs, err := newFileStore(filepath.Join(t.TempDir(), "books.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]BookStore{
+		"memory": newMemoryStore(),
+		"file":   fs,
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			s.CreateAuthor(Author{ID: "a1", Lastname: "Smith"})
+			s.Create(Book{ID: "1", Title: "First", AuthorID: "a1"})
+
+			// a taken author ID creates nothing
+			_, _, err := s.CreateMany([]Author{{ID: "a2", Lastname: "Jones"}, {ID: "a1", Lastname: "Again"}}, []Book{{ID: "2", Title: "Second", AuthorID: "a2"}})
+			if !errors.Is(err, ErrDuplicateID) {
+				t.Fatalf("CreateMany with a taken author ID: %v, want ErrDuplicateID", err)
+			}
+			if authors, _ := s.ListAuthors(); len(authors) != 1 {
+				t.Errorf("%d authors after the failed CreateMany, want 1", len(authors))
+			}
+
+			created, errs, err := s.CreateMany([]Author{{ID: "a2", Lastname: "Jones"}}, []Book{
+				{ID: "2", Title: "Second", AuthorID: "a2"},
+				{ID: "1", Title: "Taken", AuthorID: "a1"},
+				{ID: "3", Title: "Orphan", AuthorID: "nobody"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if errs[0] != nil || created[0].Version != 1 || !errors.Is(errs[1], ErrDuplicateID) || !errors.Is(errs[2], ErrAuthorNotFound) {
+				t.Errorf("CreateMany = %+v, %v", created, errs)
+			}
+			if books, _ := s.List(); len(books) != 2 {
+				t.Errorf("%d books, want 2", len(books))
+			}
+		})
+	}
+}
+
+func TestStoreVersions(t *testing.T) {
+	s := newMemoryStore()
+	created, _ := s.Create(Book{ID: "1", Title: "First"})
+	if created.Version != 1 {
+		t.Fatalf("created version = %d, want 1", created.Version)
+	}
+
+	updated, err := s.Update("1", Book{ID: "1", Title: "Second", Version: 1})
+	if err != nil || updated.Version != 2 {
+		t.Fatalf("Update at version 1 = %+v, %v, want version 2", updated, err)
+	}
+	if _, err := s.Update("1", Book{ID: "1", Title: "Stale", Version: 1}); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Update at stale version 1: error = %v, want ErrVersionConflict", err)
+	}
+	if updated, _ := s.Update("1", Book{ID: "1", Title: "Blind"}); updated.Version != 3 {
+		t.Errorf("unconditional Update gave version %d, want 3", updated.Version)
+	}
+	if err := s.Delete("1", 2, ""); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Delete at stale version 2: error = %v, want ErrVersionConflict", err)
+	}
+	if err := s.Delete("1", 3, ""); err != nil {
+		t.Errorf("Delete at current version 3: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The book and author routes are served under every version of the API:
+//
+//	/api/v1  a book names its author by author_id, and embeds it only
+//	         for ?expand=author
+//	/api/v2  a book always embeds its author, and request bodies name it
+//	         the same way: "author": {"id": "7"}, or the author's names to
+//	         match or create one as in v1
+//	/api     v1, for clients from before there were versions
+//
+// The handlers only know v1; apiVersion translates books to and from the
+// other versions on the way in and out. Only books differ between
+// versions: authors, history, events, imports and exports look the same
+// in all of them.
+//
+// Books can be sent as JSON, XML or CSV (the columns of an export),
+// whichever the Accept header prefers. Everything else is JSON, apart from
+// exports and the event stream. A request that accepts none of what a
+// route can send gets a 406.
+//
+// Each representation of a book has an ETag of its own, which starts with
+// the book's version, so any of them will do for If-Match.
+
+const (
+	jsonType = "application/json"
+	xmlType  = "application/xml"
+)
+
+// the media types each kind of route can answer with, preferred first
+var (
+	bookTypes   = []string{jsonType, xmlType, "text/xml", csvType}
+	jsonTypes   = []string{jsonType}
+	exportTypes = []string{csvType, ndjsonType}
+	eventTypes  = []string{"text/event-stream"}
+)
+
+// apiVersion is a version of the API and the prefix its routes are under
+type apiVersion struct {
+	prefix string
+	number int
+}
+
+var apiVersions = []apiVersion{{"/api/v1", 1}, {"/api/v2", 2}, {"/api", 1}}
+
+// apiPrefix is the prefix of the version r was made to, for building
+// links to other resources in the same version
+func apiPrefix(r *http.Request) string {
+	for _, v := range apiVersions {
+		if strings.HasPrefix(r.URL.Path, v.prefix+"/") {
+			return v.prefix
+		}
+	}
+	return "/api"
+}
+
+// bookV2 is a book as /api/v2 represents it
+type bookV2 struct {
+	ID        string    `json:"id" xml:"id"`
+	Isbn      string    `json:"isbn" xml:"isbn"`
+	Title     string    `json:"title" xml:"title"`
+	Author    *Author   `json:"author" xml:"author"`
+	Version   int       `json:"version" xml:"version"`
+	UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+	UpdatedBy string    `json:"updated_by,omitempty" xml:"updated_by,omitempty"`
+}
+
+// toV2 translates a book with its author filled in
+func toV2(b Book) bookV2 {
+	author := b.Author
+	if author == nil && b.AuthorID != "" {
+		author = &Author{ID: b.AuthorID} // the author has gone missing from the store
+	}
+	return bookV2{ID: b.ID, Isbn: b.Isbn, Title: b.Title, Author: author, Version: b.Version, UpdatedAt: b.UpdatedAt, UpdatedBy: b.UpdatedBy}
+}
+
+// books serves a handler that answers with a Book or a list of them as v1
+// JSON. Request bodies are translated to v1 for it, and its answers into
+// v's representation and the media type the client prefers.
+func (v apiVersion) books(h http.HandlerFunc) http.HandlerFunc {
+	return v.serve(bookTypes, func(w http.ResponseWriter, r *http.Request) {
+		if v.number == 2 {
+			if err := v2Body(r); err != nil {
+				badBody(w, r, "valid JSON", err)
+				return
+			}
+		}
+		mediaType := negotiate(r.Header.Get("Accept"), bookTypes)
+		if v.number == 1 && mediaType == jsonType {
+			h(w, r) // already in the right shape
+			return
+		}
+
+		// h's tags are for its v1 JSON, so it mustn't judge If-None-Match:
+		// writeBooks does, against the tag of what it sends
+		inner := r.Clone(r.Context())
+		inner.Header.Del("If-None-Match")
+		buf := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+		h(buf, inner)
+		if buf.status < 200 || buf.status > 299 || buf.body.Len() == 0 || !strings.HasPrefix(w.Header().Get("Content-Type"), jsonType) {
+			w.WriteHeader(buf.status) // an error or no body, sent as is
+			w.Write(buf.body.Bytes())
+			return
+		}
+		v.writeBooks(w, r, buf.status, buf.body.Bytes(), mediaType)
+	})
+}
+
+// plain, export and events serve handlers whose answers are the same in
+// every version
+func (v apiVersion) plain(h http.HandlerFunc) http.HandlerFunc  { return v.serve(jsonTypes, h) }
+func (v apiVersion) export(h http.HandlerFunc) http.HandlerFunc { return v.serve(exportTypes, h) }
+func (v apiVersion) events(h http.HandlerFunc) http.HandlerFunc { return v.serve(eventTypes, h) }
+
+// serve answers a request that accepts none of offers with a 406, and
+// leaves the rest to h
+func (v apiVersion) serve(offers []string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if negotiate(r.Header.Get("Accept"), offers) == "" {
+			writeProblem(w, r, http.StatusNotAcceptable, "this can only be sent as "+strings.Join(offers, ", "))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// v2Body translates a v2 book in a POST, PUT or PATCH body into v1: an
+// author with an id becomes an author_id. Bodies that aren't JSON objects
+// are left for the handler to refuse.
+func v2Body(r *http.Request) error {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		return nil
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	var book map[string]interface{}
+	if json.Unmarshal(data, &book) == nil && book != nil {
+		delete(book, "author_id") // not part of v2
+		if author, ok := book["author"].(map[string]interface{}); ok {
+			if id, _ := author["id"].(string); id != "" {
+				book["author_id"] = id
+				delete(book, "author")
+			}
+		}
+		data, _ = json.Marshal(book)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	return nil
+}
+
+// writeBooks re-encodes the v1 JSON of a book or a list of books in v's
+// representation as mediaType
+func (v apiVersion) writeBooks(w http.ResponseWriter, r *http.Request, status int, body []byte, mediaType string) {
+	var books []Book
+	list := bytes.HasPrefix(bytes.TrimSpace(body), []byte("["))
+	var err error
+	if list {
+		err = json.Unmarshal(body, &books)
+	} else {
+		books = make([]Book, 1)
+		err = json.Unmarshal(body, &books[0])
+	}
+	if err == nil && (v.number == 2 || mediaType == csvType) {
+		books, err = withAuthors(books) // v2 and the CSV columns always have the author
+	}
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+
+	// the book, or the list of them, in v's representation
+	var out interface{}
+	if v.number == 2 {
+		translated := make([]bookV2, len(books))
+		for i, b := range books {
+			translated[i] = toV2(b)
+		}
+		out = translated
+		if !list {
+			out = translated[0]
+		}
+	} else {
+		out = books
+		if !list {
+			out = books[0]
+		}
+	}
+
+	var enc bytes.Buffer
+	contentType := mediaType + "; charset=utf-8"
+	switch mediaType {
+	case csvType:
+		cw := csv.NewWriter(&enc)
+		cw.Write(csvColumns)
+		for _, b := range books {
+			cw.Write(csvRecord(b))
+		}
+		cw.Flush()
+	case jsonType:
+		contentType = jsonType
+		json.NewEncoder(&enc).Encode(out)
+	default:
+		enc.WriteString(xml.Header)
+		xe := xml.NewEncoder(&enc)
+		if list {
+			xe.Encode(struct {
+				XMLName xml.Name    `xml:"books"`
+				Books   interface{} `xml:"book"`
+			}{Books: out})
+		} else {
+			xe.EncodeElement(out, xml.StartElement{Name: xml.Name{Local: "book"}})
+		}
+		enc.WriteString("\n")
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", contentType)
+	// a tagged book keeps its version in the tag, but the rest of the tag
+	// is this representation's own
+	if version, ok := tagVersion(w.Header().Get("ETag")); ok {
+		tag := variantETag(version, []byte(contentType), enc.Bytes())
+		w.Header().Set("ETag", tag)
+		inm := r.Header.Get("If-None-Match")
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) && status == http.StatusOK && inm != "" && weakMatch(inm, tag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.WriteHeader(status)
+	w.Write(enc.Bytes())
+}
+
+// bufferedResponse holds on to a handler's answer so it can be re-encoded.
+// It shares the real response's headers.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+// negotiate returns the offer the Accept header accept likes best, the
+// first offer if there is no Accept header, or "" if it accepts none of
+// them. Ties go to the earlier offer.
+func negotiate(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := acceptQ(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQ is the quality accept gives mediaType, taken from the most
+// specific range that matches it: type/subtype, then type/*, then */*
+func acceptQ(accept, mediaType string) float64 {
+	major := mediaType[:strings.IndexByte(mediaType, '/')]
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rng, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		s := -1
+		switch rng {
+		case mediaType:
+			s = 2
+		case major + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+	}
+	return q
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", jsonType},
+		{"*/*", jsonType},
+		{"application/xml", xmlType},
+		{"text/*", "text/xml"},
+		{"text/csv, application/json;q=0.5", csvType},
+		{"application/json;q=0.5, text/csv;q=0.9", csvType},
+		{"application/*;q=0.2, application/xml;q=0", jsonType},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", xmlType},
+		{"image/png", ""},
+		{"application/json;q=0", ""},
+	}
+	for _, tc := range tests {
+		if got := negotiate(tc.accept, bookTypes); got != tc.want {
+			t.Errorf("negotiate(%q) = %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestVersionedBooks(t *testing.T) {
+	useStore(t, Book{ID: "1", Isbn: "0306406152", Title: "Go in Action", Author: &Author{Firstname: "Bill", Lastname: "Kennedy"}})
+	router := newRouter()
+	authorID := storedBook(t, "1").AuthorID
+
+	for _, path := range []string{"/api/books/1", "/api/v1/books/1"} {
+		var v1 map[string]interface{}
+		json.NewDecoder(do(t, router, "GET", path, "").Body).Decode(&v1)
+		if v1["author_id"] != authorID || v1["author"] != nil {
+			t.Errorf("GET %s = %v, want author_id and no author", path, v1)
+		}
+	}
+	var v2 map[string]interface{}
+	json.NewDecoder(do(t, router, "GET", "/api/v2/books/1", "").Body).Decode(&v2)
+	if author, _ := v2["author"].(map[string]interface{}); author["id"] != authorID || author["lastname"] != "Kennedy" || v2["author_id"] != nil {
+		t.Errorf("GET /api/v2/books/1 = %v, want the author embedded and no author_id", v2)
+	}
+
+	// v2 names the author by author.id
+	rec := do(t, router, "POST", "/api/v2/books", `{"title":"Go Web Programming","author":{"id":"`+authorID+`"}}`)
+	var created bookV2
+	json.NewDecoder(rec.Body).Decode(&created)
+	if rec.Code != http.StatusCreated || created.Author == nil || created.Author.Lastname != "Kennedy" || !strings.HasPrefix(rec.Header().Get("Location"), "/api/v2/books/") {
+		t.Fatalf("POST /api/v2/books = %d %+v Location %s", rec.Code, created, rec.Header().Get("Location"))
+	}
+	if stored := storedBook(t, created.ID); stored.AuthorID != authorID {
+		t.Errorf("stored author_id = %q, want %q", stored.AuthorID, authorID)
+	}
+	req := editorRequest("PATCH", "/api/v2/books/"+created.ID, `{"author":{"lastname":"Chang"}}`)
+	req.Header.Set("Content-Type", mergePatchType)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	json.NewDecoder(rec.Body).Decode(&created)
+	if rec.Code != http.StatusOK || created.Author.Lastname != "Chang" || created.Author.ID == authorID {
+		t.Errorf("PATCH a new author by name = %d %+v", rec.Code, created)
+	}
+	if rec := do(t, router, "POST", "/api/v2/books", `{"title":"Orphan","author":{"id":"404"}}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST /api/v2/books with an unknown author = %d, want 422", rec.Code)
+	}
+
+	var list []bookV2
+	rec = do(t, router, "GET", "/api/v2/authors/"+authorID+"/books", "")
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list) != 1 || list[0].Author == nil || list[0].Author.Firstname != "Bill" || rec.Header().Get("X-Total-Count") != "1" {
+		t.Errorf("GET /api/v2/authors/%s/books = %+v, total %s", authorID, list, rec.Header().Get("X-Total-Count"))
+	}
+	if rec := do(t, router, "POST", "/api/v1/authors", `{"firstname":"Alan","lastname":"Donovan"}`); !strings.HasPrefix(rec.Header().Get("Location"), "/api/v1/authors/") {
+		t.Errorf("POST /api/v1/authors Location = %q", rec.Header().Get("Location"))
+	}
+}
+
+func TestBookRepresentations(t *testing.T) {
+	useStore(t,
+		Book{ID: "1", Isbn: "0306406152", Title: "Go in Action", Author: &Author{Firstname: "Bill", Lastname: "Kennedy"}},
+		Book{ID: "2", Title: "Concurrency in Go", Author: &Author{Firstname: "Katherine", Lastname: "Cox-Buday"}},
+	)
+	router := newRouter()
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := editorRequest("GET", path, "")
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/api/v1/books?sort=id", "application/xml")
+	var books struct {
+		Books []Book `xml:"book"`
+	}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &books); err != nil || rec.Header().Get("Content-Type") != "application/xml; charset=utf-8" {
+		t.Fatalf("XML list: %v, Content-Type %q\n%s", err, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	if len(books.Books) != 2 || books.Books[0].Title != "Go in Action" || books.Books[0].Author != nil || rec.Header().Get("X-Total-Count") != "2" {
+		t.Errorf("XML list = %+v", books.Books)
+	}
+
+	rec = get("/api/v2/books/1", "text/xml")
+	var one bookV2
+	if err := xml.Unmarshal(rec.Body.Bytes(), &one); err != nil || one.Author == nil || one.Author.Lastname != "Kennedy" || !strings.HasPrefix(rec.Header().Get("ETag"), `"1-`) {
+		t.Errorf("v2 XML book = %+v, %v, ETag %s\n%s", one, err, rec.Header().Get("ETag"), rec.Body)
+	}
+
+	rec = get("/api/books/search?q=go&sort=-title", "text/csv")
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil || len(records) != 3 || strings.Join(records[0], ",") != strings.Join(csvColumns, ",") {
+		t.Fatalf("CSV search = %v, %v", records, err)
+	}
+	if records[1][2] != "Go in Action" || records[1][5] != "Kennedy" {
+		t.Errorf("first CSV row = %v", records[1])
+	}
+
+	if rec := get("/api/v1/books/404", "application/xml"); rec.Code != http.StatusNotFound || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/problem+json") {
+		t.Errorf("missing book as XML = %d %s, want a 404 problem", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	for _, path := range []string{"/api/v1/books/1", "/api/v2/books", "/api/authors", "/api/v1/books:export"} {
+		if rec := get(path, "image/png"); rec.Code != http.StatusNotAcceptable || !strings.Contains(rec.Header().Get("Vary"), "Accept") {
+			t.Errorf("GET %s as image/png = %d, want 406", path, rec.Code)
+		}
+	}
+	if rec := get("/api/authors", "text/csv"); rec.Code != http.StatusNotAcceptable {
+		t.Errorf("authors as CSV = %d, want 406", rec.Code)
+	}
+	if rec := get("/api/v1/books:export", "application/x-ndjson"); rec.Header().Get("Content-Type") != ndjsonType {
+		t.Errorf("export accepting NDJSON sent %s", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestRepresentationETags(t *testing.T) {
+	useStore(t, Book{ID: "1", Title: "Go in Action", Author: &Author{Firstname: "Bill", Lastname: "Kennedy"}})
+	router := newRouter()
+	send := func(method, path, accept, header, tag, body string) *httptest.ResponseRecorder {
+		req := editorRequest(method, path, body)
+		req.Header.Set("Accept", accept)
+		if header != "" {
+			req.Header.Set(header, tag)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tags := map[string]string{}
+	for _, r := range []struct{ path, accept string }{
+		{"/api/v1/books/1", jsonType},
+		{"/api/v1/books/1", xmlType},
+		{"/api/v1/books/1", "text/xml"},
+		{"/api/v1/books/1", csvType},
+		{"/api/v2/books/1", jsonType},
+		{"/api/v2/books/1", xmlType},
+	} {
+		tag := send("GET", r.path, r.accept, "", "", "").Header().Get("ETag")
+		if _, ok := tagVersion(tag); !ok || strings.HasPrefix(tag, "W/") {
+			t.Errorf("GET %s as %s: ETag %s, want a strong tag of version 1", r.path, r.accept, tag)
+		}
+		for other, otherTag := range tags {
+			if tag == otherTag {
+				t.Errorf("GET %s as %s has the same ETag as %s: %s", r.path, r.accept, other, tag)
+			}
+		}
+		tags[r.path+" as "+r.accept] = tag
+
+		if rec := send("GET", r.path, r.accept, "If-None-Match", tag, ""); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("GET %s as %s with its own tag = %d, want 304", r.path, r.accept, rec.Code)
+		}
+	}
+	v1, v2 := tags["/api/v1/books/1 as "+jsonType], tags["/api/v2/books/1 as "+jsonType]
+	if rec := send("GET", "/api/v2/books/1", jsonType, "If-None-Match", v1, ""); rec.Code != http.StatusOK {
+		t.Errorf("v2 with the v1 tag = %d, want 200: they aren't the same answer", rec.Code)
+	}
+	if rec := send("GET", "/api/v1/books/1", jsonType, "If-None-Match", v2, ""); rec.Code != http.StatusOK {
+		t.Errorf("v1 with the v2 tag = %d, want 200", rec.Code)
+	}
+
+	// any representation's tag says which version a change applies to
+	authorID := storedBook(t, "1").AuthorID
+	rec := send("PUT", "/api/v2/books/1", xmlType, "If-Match", tags["/api/v2/books/1 as "+xmlType], `{"title":"Go in Action, 2nd ed.","author":{"id":"`+authorID+`"}}`)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("ETag"), `"2-`) {
+		t.Errorf("PUT with the v2 XML tag = %d, ETag %s", rec.Code, rec.Header().Get("ETag"))
+	}
+	if rec := send("PUT", "/api/v2/books/1", jsonType, "If-Match", v2, `{"title":"Stale","author":{"id":"`+authorID+`"}}`); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with a tag of version 1 = %d, want 412", rec.Code)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every webhook delivery is a POST of the Event as JSON, with headers
+//
+//	X-Books-Event:     the event type
+//	X-Books-Delivery:  the event ID, the same on every retry
+//	X-Books-Timestamp: Unix seconds when this attempt was sent
+//	X-Books-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// signed with the webhook secret. Receivers should check the signature
+// and reject old timestamps to stop replays.
+
+// maxDeadLetters caps how many failed deliveries are kept for inspection
+const maxDeadLetters = 1000
+
+// deadLetter is a delivery that was given up on
+type deadLetter struct {
+	URL      string    `json:"url"`
+	Event    Event     `json:"event"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// webhooks sends every event on the bus to each configured URL. Each URL
+// has a queue and a worker of its own, so a slow or broken receiver only
+// holds up its own deliveries, which arrive in order.
+type webhooks struct {
+	urls     []string
+	secret   []byte
+	client   *http.Client
+	buffer   int           // events held for each URL before they are dead-lettered
+	attempts int           // tries per delivery before it is dead-lettered
+	backoff  time.Duration // wait before the first retry, doubled for each one after
+	now      func() time.Time
+
+	// subscribed is closed once run is listening to the bus
+	subscribed chan struct{}
+
+	mu   sync.Mutex
+	dead []deadLetter
+}
+
+// hooks delivers events to the configured webhooks; it has no URLs unless
+// main sets some
+var hooks = newWebhooks(nil, "")
+
+func newWebhooks(urls []string, secret string) *webhooks {
+	return &webhooks{
+		urls:     urls,
+		secret:   []byte(secret),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		buffer:   1000,
+		attempts: 6,
+		backoff:  time.Second,
+		now:      time.Now,
+
+		subscribed: make(chan struct{}),
+	}
+}
+
+// run delivers events until ctx is cancelled. Deliveries still being
+// retried then are abandoned.
+func (h *webhooks) run(ctx context.Context) {
+	if len(h.urls) == 0 {
+		close(h.subscribed)
+		return
+	}
+	var wg sync.WaitGroup
+	queues := make([]chan Event, len(h.urls))
+	for i, url := range h.urls {
+		queues[i] = make(chan Event, h.buffer)
+		wg.Add(1)
+		go func(url string, queue <-chan Event) {
+			defer wg.Done()
+			for {
+				select {
+				case e := <-queue:
+					h.deliver(ctx, url, e)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(url, queues[i])
+	}
+
+	ch, cancel, last := events.subscribeAt(h.buffer)
+	close(h.subscribed)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	// every event after last is either enqueued or dead-lettered
+	handle := func(e Event) {
+		seq, _ := events.sequence(e.ID)
+		if seq <= last {
+			return // already handled while catching up
+		}
+		if seq > last+1 {
+			h.buryGap(last+1, seq-1)
+		}
+		h.enqueue(queues, e)
+		last = seq
+	}
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				// fell behind the bus; pick up again from what it remembers,
+				// and dead-letter what it has already forgotten
+				cancel()
+				var head uint64
+				ch, cancel, head = events.subscribeAt(h.buffer)
+				for _, e := range events.since(events.eventID(last)) {
+					handle(e)
+				}
+				if head > last {
+					h.buryGap(last+1, head)
+					last = head
+				}
+				continue
+			}
+			handle(e)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// enqueue hands e to every URL's worker, dead-lettering it for receivers
+// that are so far behind their queue is full
+func (h *webhooks) enqueue(queues []chan Event, e Event) {
+	for i, q := range queues {
+		select {
+		case q <- e:
+		default:
+			h.bury(h.urls[i], e, 0, "delivery queue full")
+		}
+	}
+}
+
+// buryGap dead-letters, for every URL, the events numbered from to to that
+// run fell too far behind to see. Only their IDs are known.
+func (h *webhooks) buryGap(from, to uint64) {
+	log.Printf("webhooks: fell behind the event bus, giving up on events %s to %s", events.eventID(from), events.eventID(to))
+	if to-from >= maxDeadLetters {
+		from = to - maxDeadLetters + 1 // the rest would be dropped anyway
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for seq := from; seq <= to; seq++ {
+		for _, url := range h.urls {
+			h.dead = append(h.dead, deadLetter{URL: url, Event: Event{ID: events.eventID(seq)}, Error: "missed: fell behind the event bus", FailedAt: h.now().UTC()})
+		}
+	}
+	if len(h.dead) > maxDeadLetters {
+		h.dead = h.dead[len(h.dead)-maxDeadLetters:]
+	}
+}
+
+// deliver sends e to url, retrying with exponential backoff and jitter on
+// network errors, 5xx and 429 answers. Any other failure, or running out
+// of attempts, dead-letters the event.
+func (h *webhooks) deliver(ctx context.Context, url string, e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		h.bury(url, e, 0, err.Error())
+		return
+	}
+	wait := h.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := h.send(ctx, url, e, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == h.attempts {
+			h.bury(url, e, attempt, err.Error())
+			return
+		}
+		jittered := wait/2 + time.Duration(rand.Int63n(int64(wait)/2+1))
+		select {
+		case <-time.After(jittered):
+		case <-ctx.Done():
+			return
+		}
+		wait *= 2
+	}
+}
+
+// send makes one delivery attempt and says whether a failure is worth
+// another try
+func (h *webhooks) send(ctx context.Context, url string, e Event, body []byte) (retry bool, err error) {
+	timestamp := strconv.FormatInt(h.now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "books-webhooks/1")
+	req.Header.Set("X-Books-Event", string(e.Type))
+	req.Header.Set("X-Books-Delivery", e.ID)
+	req.Header.Set("X-Books-Timestamp", timestamp)
+	req.Header.Set("X-Books-Signature", "sha256="+sign(h.secret, timestamp, body))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("receiver answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+}
+
+// sign is the hex HMAC-SHA256 of "<timestamp>.<body>" under secret
+func sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bury adds a failed delivery to the dead letters, dropping the oldest
+// once there are too many
+func (h *webhooks) bury(url string, e Event, attempts int, reason string) {
+	log.Printf("webhook %s: giving up on event %s after %d attempts: %s", url, e.ID, attempts, reason)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dead = append(h.dead, deadLetter{URL: url, Event: e, Attempts: attempts, Error: reason, FailedAt: h.now().UTC()})
+	if len(h.dead) > maxDeadLetters {
+		h.dead = h.dead[len(h.dead)-maxDeadLetters:]
+	}
+}
+
+// deadLetters returns a copy of the failed deliveries, oldest first
+func (h *webhooks) deadLetters() []deadLetter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]deadLetter{}, h.dead...)
+}
+
+func getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, hooks.deadLetters())
+}
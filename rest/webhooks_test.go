@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a webhook endpoint that answers with statuses in turn,
+// repeating the last one, and records what it was sent
+type receiver struct {
+	mu         sync.Mutex
+	statuses   []int
+	deliveries []*http.Request
+	bodies     [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.deliveries = append(rc.deliveries, r)
+	rc.bodies = append(rc.bodies, body)
+	status := rc.statuses[0]
+	if len(rc.statuses) > 1 {
+		rc.statuses = rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.deliveries)
+}
+
+// startHooks runs webhooks for urls until the test ends
+func startHooks(t *testing.T, urls ...string) *webhooks {
+	t.Helper()
+	h := newWebhooks(urls, "s3cret")
+	h.backoff = time.Millisecond
+	h.attempts = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	<-h.subscribed
+	return h
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusNoContent}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	startHooks(t, srv.URL)
+
+	events.publish(Event{Type: BookCreated, Book: Book{ID: "1", Title: "Sample book"}})
+	eventually(t, "a delivery", func() bool { return rc.count() == 1 })
+
+	req, body := rc.deliveries[0], rc.bodies[0]
+	timestamp := req.Header.Get("X-Books-Timestamp")
+	if want := "sha256=" + sign([]byte("s3cret"), timestamp, body); req.Header.Get("X-Books-Signature") != want {
+		t.Errorf("signature = %q, want %q", req.Header.Get("X-Books-Signature"), want)
+	}
+	var e Event
+	json.Unmarshal(body, &e)
+	if e.Type != BookCreated || e.Book.Title != "Sample book" || req.Header.Get("X-Books-Event") != "book.created" || req.Header.Get("X-Books-Delivery") != e.ID {
+		t.Errorf("delivered %+v with headers %v", e, req.Header)
+	}
+}
+
+func TestWebhookRetriesThenDeadLetters(t *testing.T) {
+	flaky := &receiver{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}}
+	down := &receiver{statuses: []int{http.StatusBadGateway}}
+	rejecting := &receiver{statuses: []int{http.StatusBadRequest}}
+	var urls []string
+	for _, rc := range []*receiver{flaky, down, rejecting} {
+		srv := httptest.NewServer(rc)
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+	h := startHooks(t, urls...)
+
+	events.publish(Event{Type: BookUpdated, Book: Book{ID: "1"}})
+	// the flaky receiver's last try can land after the others give up
+	eventually(t, "two dead letters and a delivery", func() bool { return len(h.deadLetters()) == 2 && flaky.count() == 3 })
+
+	if flaky.count() != 3 {
+		t.Errorf("flaky receiver got %d attempts, want 3 (two retries)", flaky.count())
+	}
+	if down.count() != 3 {
+		t.Errorf("receiver that is down got %d attempts, want 3", down.count())
+	}
+	if rejecting.count() != 1 {
+		t.Errorf("receiver answering 400 got %d attempts, want 1: it won't get better", rejecting.count())
+	}
+	byURL := map[string]deadLetter{}
+	for _, d := range h.deadLetters() {
+		byURL[d.URL] = d
+	}
+	if d := byURL[urls[1]]; d.Attempts != 3 || d.Event.Type != BookUpdated {
+		t.Errorf("dead letter for the receiver that is down = %+v", d)
+	}
+	if d := byURL[urls[2]]; d.Attempts != 1 {
+		t.Errorf("dead letter for the rejecting receiver = %+v", d)
+	}
+}
+
+func TestWebhooksAccountForEveryEvent(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusNoContent}}
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Millisecond)
+		rc.ServeHTTP(w, r)
+	}))
+	defer slow.Close()
+	h := newWebhooks([]string{slow.URL}, "s3cret")
+	h.buffer = 4
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	<-h.subscribed
+
+	// far more than the buffers hold, and than the bus remembers
+	const published = 2 * recentEvents
+	ids := map[string]bool{}
+	for i := 0; i < published; i++ {
+		e := Event{Type: BookUpdated, Book: Book{ID: "1", Version: i + 1}}
+		events.publish(e)
+	}
+	for _, e := range events.since(events.eventID(0)) {
+		ids[e.ID] = true
+	}
+	accounted := func() map[string]int {
+		seen := map[string]int{}
+		rc.mu.Lock()
+		for _, body := range rc.bodies {
+			var e Event
+			json.Unmarshal(body, &e)
+			seen[e.ID]++
+		}
+		rc.mu.Unlock()
+		for _, d := range h.deadLetters() {
+			seen[d.Event.ID]++
+		}
+		return seen
+	}
+	eventually(t, "every event delivered or dead-lettered", func() bool { return len(accounted()) == published })
+
+	seen := accounted()
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("event %s was delivered or dead-lettered %d times, want once", id, n)
+		}
+	}
+	for id := range ids {
+		if seen[id] == 0 {
+			t.Errorf("event %s was neither delivered nor dead-lettered", id)
+		}
+	}
+	if len(h.deadLetters()) == 0 {
+		t.Error("nothing was dead-lettered, so the test didn't make webhooks fall behind")
+	}
+}
+
+func TestDeadLettersEndpoint(t *testing.T) {
+	saved := hooks
+	defer func() { hooks = saved }()
+	hooks = newWebhooks([]string{"http://example.invalid/hook"}, "s3cret")
+	hooks.bury("http://example.invalid/hook", Event{ID: "e-1", Type: BookDeleted}, 6, "receiver answered 502 Bad Gateway")
+
+	rec := do(t, newRouter(), "GET", "/api/webhooks/dead-letters", "")
+	var dead []deadLetter
+	json.NewDecoder(rec.Body).Decode(&dead)
+	if rec.Code != http.StatusOK || len(dead) != 1 || dead[0].Event.ID != "e-1" {
+		t.Fatalf("dead letters = %d %+v, want the one buried", rec.Code, dead)
+	}
+
+	anonymous := httptest.NewRecorder()
+	newRouter().ServeHTTP(anonymous, httptest.NewRequest("GET", "/api/webhooks/dead-letters", nil))
+	if anonymous.Code != http.StatusUnauthorized {
+		t.Errorf("dead letters without credentials = %d, want 401", anonymous.Code)
+	}
+}